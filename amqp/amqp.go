@@ -2,16 +2,31 @@ package amqp
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/cyverse-de/messaging/v9"
 	"github.com/cyverse-de/resource-usage-api/logging"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "amqp"})
 
+const otelName = "github.com/cyverse-de/resource-usage-api/amqp"
+
+// consumerTag identifies the job update consumer on its channel so that it can
+// be cancelled during shutdown.
+const consumerTag = "resource-usage-api"
+
+// resubscribeDelay is how long to wait before consuming job updates again
+// after the channel they were delivered on closed unexpectedly.
+const resubscribeDelay = 5 * time.Second
+
 type Configuration struct {
 	URI           string
 	Reconnect     bool
@@ -19,29 +34,89 @@ type Configuration struct {
 	ExchangeType  string
 	Queue         string
 	PrefetchCount int
+
+	// The number of workers handling job updates concurrently.
+	Workers int
+
+	// The number of job updates that can wait for each worker before
+	// receiving more messages blocks.
+	QueueDepth int
+
+	// The name of the queue that job updates with unknown schema versions
+	// are sent to, which is also used as the routing key.
+	QuarantineKey string
 }
 
 type analysisUpdateJob struct {
 	UUID     string `json:"uuid"`
 	CondorID string `json:"condor_id"` // not actually used for anything...yet.
+	Username string `json:"username"`
 }
 
 type analysisUpdateMsg struct {
 	Job     analysisUpdateJob  `json:"Job"`
+	Version int                `json:"Version"`
 	State   messaging.JobState `json:"State"`
 	Message string             `json:"Message"`
 	SentOn  string             `json:"SentOn"`
 	Sender  string             `json:"Sender"`
 }
 
-type HandlerFn func(context context.Context, externalID string, state messaging.JobState)
+// CanceledState is the state of a job that was canceled by the user. The
+// messaging library doesn't define it, but it's sent by the job services.
+const CanceledState messaging.JobState = "Canceled"
+
+// JobUpdate contains the information from a job status update that's needed to
+// account for the job's resource usage.
+type JobUpdate struct {
+	// The external ID of the job step that the update is for.
+	ExternalID string
+
+	// The state the job step is in.
+	State messaging.JobState
+
+	// The username of the user who submitted the job, if the update
+	// included it.
+	Username string
+
+	// When the update was sent. Falls back to the time the update was
+	// received if the sender didn't include a usable timestamp.
+	SentOn time.Time
+}
+
+// HandlerFn handles a job update. Updates that the handler returns an error
+// for are requeued once, and quarantined if handling them fails again.
+type HandlerFn func(context context.Context, update *JobUpdate) error
+
+// parseSentOn parses the sent-on time from a job status update, which should
+// be the number of milliseconds since the epoch.
+func parseSentOn(sentOn string) (time.Time, error) {
+	millis, err := strconv.ParseInt(sentOn, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis).UTC(), nil
+}
 
 type AMQP struct {
-	client  *messaging.Client
-	handler HandlerFn
+	client *messaging.Client
+	config *Configuration
+	pool   *workerPool
+
+	// The channel job updates are consumed on. Guarded by mu, along with
+	// stopped, which is set once Close has been called.
+	mu      sync.Mutex
+	channel *amqp.Channel
+	stopped bool
+
+	stop      chan struct{}
+	consuming sync.WaitGroup
 }
 
-func New(config *Configuration, handler HandlerFn) (*AMQP, error) {
+// New connects to the AMQP broker and sets up publishing. Messages aren't
+// consumed until Consume is called, which allows the handler to depend on
+// things that need the client for publishing.
+func New(config *Configuration) (*AMQP, error) {
 	log.Debug("creating a new AMQP client")
 	client, err := messaging.NewClient(config.URI, config.Reconnect)
 	if err != nil {
@@ -50,8 +125,9 @@ func New(config *Configuration, handler HandlerFn) (*AMQP, error) {
 	log.Debug("done creating a new AMQP client")
 
 	a := &AMQP{
-		client:  client,
-		handler: handler,
+		client: client,
+		config: config,
+		stop:   make(chan struct{}),
 	}
 
 	if err = a.client.SetupPublishing(config.Exchange); err != nil {
@@ -60,60 +136,235 @@ func New(config *Configuration, handler HandlerFn) (*AMQP, error) {
 
 	go a.client.Listen()
 
+	return a, err
+}
+
+// Consume starts passing job status updates to the handler. Updates for the
+// same analysis step are handled one at a time, in the order they were
+// received.
+func (a *AMQP) Consume(handler HandlerFn) error {
+	a.pool = newWorkerPool(a.config.Workers, a.config.QueueDepth, handler)
+
+	// Declare the quarantine queue up front so that quarantined updates are
+	// kept even if nothing is consuming them.
+	channel, err := a.client.CreateQueue(a.config.QuarantineKey, a.config.Exchange, a.config.QuarantineKey, true, false)
+	if err != nil {
+		log.WithError(err).Errorf("unable to create the quarantine queue %s", a.config.QuarantineKey)
+	} else if err = channel.Close(); err != nil {
+		log.Error(err)
+	}
+
 	log.Debug("adding a consumer")
-	client.AddConsumer(
-		config.Exchange,
-		config.ExchangeType,
-		config.Queue,
-		messaging.UpdatesKey,
-		a.recv,
-		config.PrefetchCount,
-	)
+	deliveries, err := a.subscribe()
+	if err != nil {
+		return err
+	}
 	log.Debug("done adding a consumer")
 
-	return a, err
+	a.consuming.Add(1)
+	go a.run(deliveries)
+
+	return nil
+}
+
+// subscribe opens a channel and starts consuming job updates on it. The
+// messaging client's consumers hand each delivery to its own goroutine, which
+// loses the order that they arrived in, so the deliveries are read here
+// instead.
+func (a *AMQP) subscribe() (<-chan amqp.Delivery, error) {
+	channel, err := a.client.CreateQueue(a.config.Queue, a.config.Exchange, messaging.UpdatesKey, true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.PrefetchCount > 0 {
+		if err = channel.Qos(a.config.PrefetchCount, 0, false); err != nil {
+			_ = channel.Close()
+			return nil, err
+		}
+	}
+
+	deliveries, err := channel.Consume(a.config.Queue, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		_ = channel.Close()
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		_ = channel.Close()
+		return nil, errors.New("the AMQP client is closed")
+	}
+	a.channel = channel
+
+	return deliveries, nil
+}
+
+// run passes the deliveries to recv one at a time until the consumer is
+// cancelled, subscribing again if the channel closes before then.
+func (a *AMQP) run(deliveries <-chan amqp.Delivery) {
+	defer a.consuming.Done()
+
+	for {
+		a.deliver(deliveries)
+
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(resubscribeDelay):
+			}
+
+			var err error
+			if deliveries, err = a.subscribe(); err == nil {
+				break
+			}
+			log.WithError(err).Error("unable to consume job updates, will try again")
+		}
+	}
+}
+
+// deliver passes each delivery to recv in the order it was received. It
+// returns once the deliveries channel is closed.
+func (a *AMQP) deliver(deliveries <-chan amqp.Delivery) {
+	for delivery := range deliveries {
+		context := otel.GetTextMapPropagator().Extract(context.Background(), messaging.AMQPHeaderCarrier(delivery.Headers))
+		context, span := otel.Tracer(otelName).Start(context, a.config.Queue+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+		a.recv(context, delivery)
+		span.End()
+	}
 }
 
 func (a *AMQP) recv(context context.Context, delivery amqp.Delivery) {
-	var (
-		update analysisUpdateMsg
-		err    error
-	)
+	var log = log.WithContext(context).WithFields(logrus.Fields{
+		"deliveryTag": delivery.DeliveryTag,
+		"bodySize":    len(delivery.Body),
+	})
 
-	var log = log.WithContext(context)
+	metrics.Add(metricReceived, 1)
 
-	if err = delivery.Ack(false); err != nil {
-		log.Error(err)
+	jobUpdate, err := DecodeJobUpdate(delivery.Body)
+	switch {
+	case errors.Is(err, ErrUnknownVersion):
+		metrics.Add(metricUnknownVersion, 1)
+		log.WithError(err).Warn("quarantining job update")
+		a.quarantine(context, log, delivery)
 		return
-	}
 
-	redelivered := delivery.Redelivered
-	if err = json.Unmarshal(delivery.Body, &update); err != nil {
-		log.Error(err)
-		if err = delivery.Reject(!redelivered); err != nil {
+	case errors.Is(err, ErrMalformed):
+		metrics.Add(metricMalformed, 1)
+		log.WithError(err).Error("dropping job update")
+		if err = delivery.Reject(false); err != nil {
 			log.Error(err)
 		}
 		return
+
+	case err != nil:
+		metrics.Add(metricInvalid, 1)
+		log.WithError(err).Error("dropping job update")
+		ack(log, delivery)
+		return
 	}
 
-	log.Debugf("UUID is %s", update.Job.UUID)
-	log.Debugf("state is %s", update.State)
-	log.Debugf("%+v", update)
+	metrics.Add(metricDecoded, 1)
+	log.Debugf("external ID is %s; state is %s", jobUpdate.ExternalID, jobUpdate.State)
+
+	// The message is acknowledged once it has been handled, so the prefetch
+	// count limits how many messages are waiting for a worker.
+	a.pool.submit(context, orderingKey(jobUpdate), jobUpdate, func(err error) {
+		a.handled(context, log, delivery, err)
+	})
+}
 
-	log.Infof("%s is the body", string(delivery.Body))
+// handled settles a delivery once the handler has returned. Updates that
+// couldn't be handled are requeued so that they're tried again, unless they've
+// already been redelivered, in which case they're quarantined so that a
+// persistent failure doesn't keep the update cycling through the queue.
+func (a *AMQP) handled(context context.Context, log *logrus.Entry, delivery amqp.Delivery, err error) {
+	if err == nil {
+		ack(log, delivery)
+		return
+	}
 
-	if update.State == "" {
-		log.Error("state was unset, dropping message")
+	metrics.Add(metricHandlerFailed, 1)
+	if !delivery.Redelivered {
+		log.WithError(err).Warn("unable to handle the job update, requeueing it")
+		if err = delivery.Nack(false, true); err != nil {
+			log.Error(err)
+		}
 		return
 	}
-	if update.Job.UUID == "" {
-		log.Error("external ID was unset, dropping message")
+
+	log.WithError(err).Error("unable to handle the redelivered job update, quarantining it")
+	a.quarantine(context, log, delivery)
+}
+
+// quarantine republishes a job update that this service can't handle yet
+// using the quarantine routing key, so that it can be inspected or replayed
+// later. The original message is only acknowledged if that succeeds.
+func (a *AMQP) quarantine(context context.Context, log *logrus.Entry, delivery amqp.Delivery) {
+	err := a.client.PublishContextOpts(context, a.config.QuarantineKey, delivery.Body, messaging.JSONPublishingOpts)
+	if err != nil {
+		metrics.Add(metricQuarantineFailed, 1)
+		log.WithError(err).Error("unable to quarantine the job update")
+		if err = delivery.Reject(!delivery.Redelivered); err != nil {
+			log.Error(err)
+		}
 		return
 	}
 
-	a.handler(context, update.Job.UUID, update.State)
+	metrics.Add(metricQuarantined, 1)
+	ack(log, delivery)
 }
 
+// orderingKey returns the key used to decide which worker handles an update.
+// Updates are ordered per analysis step. The username isn't used because not
+// every update includes it, which would let updates for the same step be
+// handled out of order.
+func orderingKey(update *JobUpdate) string {
+	return update.ExternalID
+}
+
+// ack acknowledges a delivery, logging any errors.
+func ack(log *logrus.Entry, delivery amqp.Delivery) {
+	if err := delivery.Ack(false); err != nil {
+		log.Error(err)
+	}
+}
+
+// PublishNotification sends a notification to the user named in the message
+// by way of the DE notification agent.
+func (a *AMQP) PublishNotification(context context.Context, msg *messaging.NotificationMessage) error {
+	return a.client.PublishNotificationMessageContext(context, &messaging.WrappedNotificationMessage{
+		Message: msg,
+	})
+}
+
+// Close stops consuming job updates, waits for the updates that have already
+// been received to be handled and acknowledged, and then closes the connection
+// to the broker.
 func (a *AMQP) Close() {
+	a.mu.Lock()
+	a.stopped = true
+	channel := a.channel
+	a.mu.Unlock()
+
+	if a.pool != nil {
+		close(a.stop)
+		if channel != nil {
+			if err := channel.Cancel(consumerTag, false); err != nil {
+				log.Error(err)
+			}
+		}
+		a.consuming.Wait()
+		a.pool.close()
+		if channel != nil {
+			if err := channel.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
 	a.client.Close()
 }
@@ -0,0 +1,127 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// acknowledger counts the deliveries that were acknowledged and requeued.
+type acknowledger struct {
+	mu       sync.Mutex
+	acked    int
+	requeued int
+}
+
+func (a *acknowledger) Ack(_ uint64, _ bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked++
+	return nil
+}
+
+func (a *acknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
+
+func (a *acknowledger) Reject(_ uint64, _ bool) error { return nil }
+
+func TestDeliverPreservesOrdering(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen = make(map[string][]time.Time)
+	)
+
+	// Handling takes a random amount of time, so updates that were handled concurrently would finish out of order.
+	handler := func(_ context.Context, update *JobUpdate) error {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		seen[update.ExternalID] = append(seen[update.ExternalID], update.SentOn)
+		return nil
+	}
+
+	a := &AMQP{config: &Configuration{Queue: "test"}, pool: newWorkerPool(4, 2, handler)}
+	acks := &acknowledger{}
+
+	const (
+		count  = 50
+		sentOn = 1700000000000
+	)
+	steps := []string{"step-a", "step-b", "step-c"}
+
+	// Deliveries arrive while earlier ones are still being handled. Only some of the updates include the username,
+	// which mustn't affect the order that a step's updates are handled in.
+	deliveries := make(chan amqp.Delivery, 10)
+	go func() {
+		defer close(deliveries)
+		tag := uint64(0)
+		for i := 0; i < count; i++ {
+			for _, step := range steps {
+				tag++
+				username := ""
+				if i%2 == 0 {
+					username = "someuser"
+				}
+				body := fmt.Sprintf(`{"Job":{"uuid":"%s","username":"%s"},"State":"Running","SentOn":"%d"}`, step, username, sentOn+i)
+				deliveries <- amqp.Delivery{Acknowledger: acks, DeliveryTag: tag, Body: []byte(body)}
+			}
+		}
+	}()
+
+	a.deliver(deliveries)
+	a.pool.close()
+
+	if acks.acked != count*len(steps) {
+		t.Errorf("expected %d acknowledgements, got %d", count*len(steps), acks.acked)
+	}
+	for _, step := range steps {
+		got := seen[step]
+		if len(got) != count {
+			t.Fatalf("%s: handled %d updates, want %d", step, len(got), count)
+		}
+		for i, sent := range got {
+			if want := time.UnixMilli(sentOn + int64(i)).UTC(); !sent.Equal(want) {
+				t.Fatalf("%s: update %d was sent on %s, want %s", step, i, sent, want)
+			}
+		}
+	}
+}
+
+func TestDeliverRequeuesFailedUpdates(t *testing.T) {
+	handler := func(_ context.Context, _ *JobUpdate) error {
+		return errors.New("database unavailable")
+	}
+
+	a := &AMQP{config: &Configuration{Queue: "test"}, pool: newWorkerPool(1, 0, handler)}
+	acks := &acknowledger{}
+
+	deliveries := make(chan amqp.Delivery, 1)
+	deliveries <- amqp.Delivery{
+		Acknowledger: acks,
+		DeliveryTag:  1,
+		Body:         []byte(`{"Job":{"uuid":"step-a"},"State":"Succeeded","SentOn":"1700000000000"}`),
+	}
+	close(deliveries)
+
+	a.deliver(deliveries)
+	a.pool.close()
+
+	if acks.acked != 0 {
+		t.Errorf("expected the failed update not to be acknowledged, got %d acknowledgements", acks.acked)
+	}
+	if acks.requeued != 1 {
+		t.Errorf("expected the failed update to be requeued, got %d requeues", acks.requeued)
+	}
+}
@@ -0,0 +1,95 @@
+package amqp
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// Counters for the job updates received from the broker, published through expvar as "amqp_job_updates".
+var metrics = expvar.NewMap("amqp_job_updates")
+
+// Metric names.
+const (
+	metricReceived         = "received"
+	metricDecoded          = "decoded"
+	metricMalformed        = "malformed"
+	metricInvalid          = "invalid"
+	metricUnknownVersion   = "unknown_version"
+	metricQuarantined      = "quarantined"
+	metricQuarantineFailed = "quarantine_failed"
+	metricHandlerFailed    = "handler_failed"
+)
+
+// ErrMalformed is returned when a job update isn't valid JSON or doesn't have the expected structure.
+var ErrMalformed = errors.New("malformed job update")
+
+// ErrInvalid is returned when a job update is missing a required field.
+var ErrInvalid = errors.New("invalid job update")
+
+// ErrUnknownVersion is returned when a job update uses a schema version this service doesn't understand.
+var ErrUnknownVersion = errors.New("unknown job update version")
+
+// versionedMsg contains just enough of a job update to determine its schema version. Updates sent before the
+// version was introduced don't have one, which is the same as version 0.
+type versionedMsg struct {
+	Version int `json:"Version"`
+}
+
+// decoder decodes a job update with a known schema version.
+type decoder func(body []byte) (*JobUpdate, error)
+
+// decoders maps the known job update schema versions to their decoders.
+var decoders = map[int]decoder{
+	0: decodeV0,
+}
+
+// decodeV0 decodes version 0 job updates, which are messaging.UpdateMessage values.
+func decodeV0(body []byte) (*JobUpdate, error) {
+	var update analysisUpdateMsg
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	if update.State == "" {
+		return nil, fmt.Errorf("%w: State is required", ErrInvalid)
+	}
+	if update.Job.UUID == "" {
+		return nil, fmt.Errorf("%w: Job.uuid is required", ErrInvalid)
+	}
+
+	jobUpdate := &JobUpdate{
+		ExternalID: update.Job.UUID,
+		State:      update.State,
+		Username:   update.Job.Username,
+	}
+
+	// The sent-on time is optional; the receipt time is a reasonable
+	// substitute.
+	sentOn, err := parseSentOn(update.SentOn)
+	if err != nil {
+		log.WithError(err).Warnf("unable to parse the sent-on time %q, using the current time", update.SentOn)
+		sentOn = time.Now().UTC()
+	}
+	jobUpdate.SentOn = sentOn
+
+	return jobUpdate, nil
+}
+
+// DecodeJobUpdate decodes and validates a job update message body. The error wraps ErrMalformed, ErrInvalid, or
+// ErrUnknownVersion if the message can't be used.
+func DecodeJobUpdate(body []byte) (*JobUpdate, error) {
+	var versioned versionedMsg
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	decode, ok := decoders[versioned.Version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, versioned.Version)
+	}
+
+	return decode(body)
+}
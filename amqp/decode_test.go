@@ -0,0 +1,64 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+)
+
+func TestDecodeJobUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"unversioned", `{"Job":{"uuid":"step-1","username":"ipcdev"},"State":"Running","SentOn":"1700000000000"}`, nil},
+		{"version 0", `{"Version":0,"Job":{"uuid":"step-1","username":"ipcdev"},"State":"Running","SentOn":"1700000000000"}`, nil},
+		{"not json", `not json`, ErrMalformed},
+		{"wrong type", `{"Job":"step-1","State":"Running"}`, ErrMalformed},
+		{"missing state", `{"Job":{"uuid":"step-1"}}`, ErrInvalid},
+		{"missing uuid", `{"Job":{"username":"ipcdev"},"State":"Running"}`, ErrInvalid},
+		{"unknown version", `{"Version":99,"Job":{"uuid":"step-1"},"State":"Running"}`, ErrUnknownVersion},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			update, err := DecodeJobUpdate([]byte(test.body))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if update.ExternalID != "step-1" {
+				t.Errorf("unexpected external ID: %s", update.ExternalID)
+			}
+			if update.State != messaging.RunningState {
+				t.Errorf("unexpected state: %s", update.State)
+			}
+			if update.Username != "ipcdev" {
+				t.Errorf("unexpected username: %s", update.Username)
+			}
+			if !update.SentOn.Equal(time.UnixMilli(1700000000000)) {
+				t.Errorf("unexpected sent-on time: %s", update.SentOn)
+			}
+		})
+	}
+}
+
+func TestDecodeJobUpdateSentOnFallback(t *testing.T) {
+	before := time.Now()
+	update, err := DecodeJobUpdate([]byte(`{"Job":{"uuid":"step-1"},"State":"Completed","SentOn":"yesterday"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if update.SentOn.Before(before.Truncate(time.Second)) {
+		t.Errorf("expected the current time to be used, got %s", update.SentOn)
+	}
+}
@@ -0,0 +1,74 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+)
+
+// UsageEventVersion is the version of the UsageEvent message format. It's
+// incremented whenever a change is made that isn't backwards compatible.
+const UsageEventVersion = 1
+
+// UsageEvent is the JSON message published on the usage routing key each time
+// this service records a resource usage for a user. Consumers should ignore
+// fields they don't recognize.
+type UsageEvent struct {
+	// The version of the message format.
+	Version int `json:"version"`
+
+	// The ID of the analysis that generated the usage, if there is one.
+	AnalysisID string `json:"analysis_id,omitempty"`
+
+	// The external ID of the analysis step that generated the usage, if
+	// there is one. Each step of a multi-step analysis is accounted for
+	// separately.
+	ExternalID string `json:"external_id,omitempty"`
+
+	// The step number of the analysis step that generated the usage, if there
+	// is one.
+	StepNumber int `json:"step_number,omitempty"`
+
+	// The user's ID in the DE database.
+	UserID string `json:"user_id"`
+
+	// The user's username, without the domain suffix.
+	Username string `json:"username"`
+
+	// The name of the resource type, e.g. "cpu.hours".
+	ResourceType string `json:"resource_type"`
+
+	// The unit the amount is measured in, e.g. "cpu hours".
+	Unit string `json:"unit"`
+
+	// The operation applied to the user's usage: ADD, SUBTRACT, or RESET.
+	Operation string `json:"operation"`
+
+	// The amount of the resource used.
+	Amount float64 `json:"amount"`
+
+	// The start of the time period the usage covers.
+	PeriodStart time.Time `json:"period_start"`
+
+	// The end of the time period the usage covers.
+	PeriodEnd time.Time `json:"period_end"`
+
+	// When the usage was recorded.
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// PublishJSON publishes a value encoded as JSON using the given routing key.
+func (a *AMQP) PublishJSON(context context.Context, key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return a.client.PublishContextOpts(context, key, body, messaging.JSONPublishingOpts)
+}
+
+// PublishUsageEvent publishes the usage event as JSON using the given routing key.
+func (a *AMQP) PublishUsageEvent(context context.Context, key string, event *UsageEvent) error {
+	return a.PublishJSON(context, key, event)
+}
@@ -0,0 +1,86 @@
+package amqp
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// work is a job update waiting to be processed by a worker. The done function
+// is called with the handler's error once the handler returns.
+type work struct {
+	context context.Context
+	update  *JobUpdate
+	done    func(error)
+}
+
+// workerPool passes job updates to the handler using a fixed number of
+// workers. Updates with the same ordering key are always sent to the same
+// worker, so they're handled one at a time in the order they were submitted.
+// Each worker has a bounded queue; submitting to a full queue blocks, which
+// holds back acknowledgements and so limits how many messages the broker
+// delivers.
+type workerPool struct {
+	queues  []chan *work
+	handler HandlerFn
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool starts size workers, each with a queue that holds up to depth
+// updates.
+func newWorkerPool(size, depth int, handler HandlerFn) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if depth < 0 {
+		depth = 0
+	}
+
+	p := &workerPool{
+		queues:  make([]chan *work, size),
+		handler: handler,
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan *work, depth)
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+
+	return p
+}
+
+func (p *workerPool) run(queue chan *work) {
+	defer p.wg.Done()
+	for w := range queue {
+		err := p.handler(w.context, w.update)
+		if w.done != nil {
+			w.done(err)
+		}
+	}
+}
+
+// queueFor returns the queue of the worker responsible for the ordering key.
+func (p *workerPool) queueFor(key string) chan *work {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// submit queues a job update for processing, blocking until there's room in
+// the worker's queue.
+func (p *workerPool) submit(context context.Context, key string, update *JobUpdate, done func(error)) {
+	p.queueFor(key) <- &work{
+		context: context,
+		update:  update,
+		done:    done,
+	}
+}
+
+// close stops accepting updates and waits for the queued ones to be handled.
+func (p *workerPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
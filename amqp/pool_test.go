@@ -0,0 +1,68 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen = make(map[string][]string)
+	)
+
+	handler := func(_ context.Context, update *JobUpdate) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[update.Username] = append(seen[update.Username], update.ExternalID)
+		return nil
+	}
+
+	p := newWorkerPool(4, 2, handler)
+
+	var acked sync.WaitGroup
+	users := []string{"alice", "bob", "carol"}
+	for i := 0; i < 50; i++ {
+		for _, user := range users {
+			update := &JobUpdate{Username: user, ExternalID: fmt.Sprintf("%s-%d", user, i)}
+			acked.Add(1)
+			p.submit(context.Background(), user, update, func(error) { acked.Done() })
+		}
+	}
+
+	acked.Wait()
+	p.close()
+
+	for _, user := range users {
+		got := seen[user]
+		if len(got) != 50 {
+			t.Fatalf("%s: handled %d updates, want 50", user, len(got))
+		}
+		for i, externalID := range got {
+			if want := fmt.Sprintf("%s-%d", user, i); externalID != want {
+				t.Fatalf("%s: update %d was %s, want %s", user, i, externalID, want)
+			}
+		}
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		update *JobUpdate
+		want   string
+	}{
+		{name: "with username", update: &JobUpdate{Username: "someuser", ExternalID: "step"}, want: "step"},
+		{name: "without username", update: &JobUpdate{ExternalID: "step"}, want: "step"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderingKey(tt.update); got != tt.want {
+				t.Errorf("orderingKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
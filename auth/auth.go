@@ -0,0 +1,124 @@
+// Package auth authenticates and authorizes requests to the HTTP API.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "auth"})
+
+// identityKey is the key used to store the caller's identity in the echo context.
+const identityKey = "auth.identity"
+
+// ErrMissingCredentials is returned when a request doesn't include any credentials.
+var ErrMissingCredentials = errors.New("no credentials were provided")
+
+// Identity describes the authenticated caller.
+type Identity struct {
+	// The caller's username, without the domain suffix.
+	Username string
+
+	// The roles the caller has been granted.
+	Roles []string
+
+	// Whether the caller has the administrator role.
+	Admin bool
+}
+
+// Authenticator determines who sent a request. It returns ErrMissingCredentials if the request doesn't include any
+// credentials, and some other error if the credentials aren't valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// bearerToken returns the bearer token from the Authorization header of a request.
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get(echo.HeaderAuthorization)
+	if header == "" {
+		return "", ErrMissingCredentials
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errors.New("the Authorization header must contain a bearer token")
+	}
+
+	return strings.TrimSpace(token), nil
+}
+
+// Middleware returns echo middleware that authenticates each request, storing the caller's identity in the context.
+// Requests without valid credentials are rejected.
+func Middleware(authenticator Authenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, err := authenticator.Authenticate(c.Request())
+			if err != nil {
+				log.WithContext(c.Request().Context()).WithError(err).Debug("authentication failed")
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+
+			c.Set(identityKey, identity)
+			return next(c)
+		}
+	}
+}
+
+// GetIdentity returns the identity of the caller, or nil if the request wasn't authenticated.
+func GetIdentity(c echo.Context) *Identity {
+	identity, _ := c.Get(identityKey).(*Identity)
+	return identity
+}
+
+// RequireIdentity returns echo middleware that allows any authenticated caller through. It must be used after
+// Middleware.
+func RequireIdentity() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetIdentity(c) == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "authentication is required")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireAdmin returns echo middleware that only allows administrators through. It must be used after Middleware.
+func RequireAdmin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity := GetIdentity(c)
+			if identity == nil || !identity.Admin {
+				return echo.NewHTTPError(http.StatusForbidden, "administrator access is required")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireSelfOrAdmin returns echo middleware that only allows requests about the user named in the given path
+// parameter through if the caller is that user or an administrator. It must be used after Middleware.
+func RequireSelfOrAdmin(param string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity := GetIdentity(c)
+			if identity == nil {
+				return echo.NewHTTPError(http.StatusForbidden, "access denied")
+			}
+
+			requested := clients.StripUsernameSuffix(c.Param(param))
+			if !identity.Admin && identity.Username != requested {
+				return echo.NewHTTPError(http.StatusForbidden, "users may only access their own resource usage")
+			}
+
+			return next(c)
+		}
+	}
+}
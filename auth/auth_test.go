@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const testKeyID = "test-key"
+
+// writeJWKS writes a key set containing the public half of key to a temporary file and returns its path.
+func writeJWKS(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	set := jwks{
+		Keys: []jwk{
+			{
+				KeyType: "RSA",
+				KeyID:   testKeyID,
+				Use:     "sig",
+				N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign returns a token for the user with the given roles, signed with key.
+func sign(t *testing.T, key *rsa.PrivateKey, username string, expires time.Time, roles ...string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"preferred_username": username,
+		"iss":                "https://auth.example.org",
+		"exp":                expires.Unix(),
+		"realm_access":       map[string]interface{}{"roles": roles},
+	})
+	token.Header["kid"] = testKeyID
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSummaryAuthorization(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeySetFile(writeJWKS(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := NewJWTAuthenticator(keys, JWTSettings{
+		Issuer:        "https://auth.example.org",
+		UsernameClaim: "preferred_username",
+		AdminRole:     "admin",
+	})
+
+	router := echo.New()
+	group := router.Group("/summary/:username")
+	group.Use(Middleware(authenticator), RequireSelfOrAdmin("username"))
+	group.GET("", func(c echo.Context) error {
+		return c.String(http.StatusOK, GetIdentity(c).Username)
+	})
+
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		expected int
+	}{
+		{"own summary", "/summary/ipcdev", sign(t, key, "ipcdev", later), http.StatusOK},
+		{"own summary with suffix", "/summary/ipcdev@iplantcollaborative.org", sign(t, key, "ipcdev", later), http.StatusOK},
+		{"another user's summary", "/summary/someone", sign(t, key, "ipcdev", later), http.StatusForbidden},
+		{"admin", "/summary/someone", sign(t, key, "ipcdev", later, "admin"), http.StatusOK},
+		{"other roles", "/summary/someone", sign(t, key, "ipcdev", later, "de-users"), http.StatusForbidden},
+		{"no token", "/summary/ipcdev", "", http.StatusUnauthorized},
+		{"expired", "/summary/ipcdev", sign(t, key, "ipcdev", time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+		{"unknown key", "/summary/ipcdev", sign(t, otherKey, "ipcdev", later), http.StatusUnauthorized},
+		{"not a token", "/summary/ipcdev", "garbage", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.expected {
+				t.Errorf("expected status %d, got %d: %s", test.expected, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
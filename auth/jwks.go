@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The minimum amount of time between fetches of a remote key set, so that tokens with unknown key IDs can't be used
+// to flood the identity provider with requests.
+const minRefreshInterval = time.Minute
+
+// The HTTP client used to fetch remote key sets.
+var httpClient = http.Client{Transport: http.DefaultTransport, Timeout: 30 * time.Second}
+
+// jwk is a single JSON Web Key. Only the fields needed for RSA and elliptic curve signing keys are included.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// jwks is a JSON Web Key Set.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// decodeBigInt decodes a base64url-encoded big-endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// publicKey returns the public key described by the JWK.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// parseJWKS returns the signing keys in a JSON Web Key Set, indexed by key ID. Keys that can't be used to verify
+// signatures are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse the key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := key.publicKey()
+		if err != nil {
+			log.WithError(err).Warnf("skipping key %q", key.KeyID)
+			continue
+		}
+		keys[key.KeyID] = publicKey
+	}
+
+	return keys, nil
+}
+
+// KeySet contains the keys used to verify token signatures.
+type KeySet struct {
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	url         string
+	lastRefresh time.Time
+}
+
+// LoadKeySetFile reads a JSON Web Key Set from a file. This is mostly useful for testing.
+func LoadKeySetFile(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+// NewRemoteKeySet returns a key set fetched from the identity provider's JWKS endpoint. The key set is fetched again
+// when a token is signed with a key it doesn't contain, so that key rotation is picked up automatically.
+func NewRemoteKeySet(context context.Context, url string) (*KeySet, error) {
+	ks := &KeySet{url: url}
+	if err := ks.refresh(context); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// refresh fetches the remote key set. The caller must hold the lock or be the only user of the key set.
+func (ks *KeySet) refresh(context context.Context) error {
+	ks.lastRefresh = time.Now()
+
+	req, err := http.NewRequestWithContext(context, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch the key set from %s: %w", ks.url, err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unable to fetch the key set from %s: status code %d", ks.url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	ks.keys = keys
+
+	return nil
+}
+
+// Key returns the key with the given ID.
+func (ks *KeySet) Key(context context.Context, keyID string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if key, ok := ks.keys[keyID]; ok {
+		return key, nil
+	}
+
+	if ks.url != "" && time.Since(ks.lastRefresh) >= minRefreshInterval {
+		if err := ks.refresh(context); err != nil {
+			return nil, err
+		}
+		if key, ok := ks.keys[keyID]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key ID %q", keyID)
+}
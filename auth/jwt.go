@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The signing methods accepted for tokens. Symmetric methods aren't allowed because the keys are public.
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWTSettings contains the settings for validating bearer tokens.
+type JWTSettings struct {
+	// The expected issuer of the tokens. Not checked if empty.
+	Issuer string
+
+	// The expected audience of the tokens. Not checked if empty.
+	Audience string
+
+	// The claim containing the caller's username.
+	UsernameClaim string
+
+	// The role that grants administrator access.
+	AdminRole string
+}
+
+// JWTAuthenticator authenticates requests using bearer JSON Web Tokens signed by a key in a key set.
+type JWTAuthenticator struct {
+	keys     *KeySet
+	settings JWTSettings
+	parser   *jwt.Parser
+}
+
+// NewJWTAuthenticator returns a new *JWTAuthenticator.
+func NewJWTAuthenticator(keys *KeySet, settings JWTSettings) *JWTAuthenticator {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(validMethods),
+		jwt.WithExpirationRequired(),
+	}
+	if settings.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(settings.Issuer))
+	}
+	if settings.Audience != "" {
+		opts = append(opts, jwt.WithAudience(settings.Audience))
+	}
+
+	return &JWTAuthenticator{
+		keys:     keys,
+		settings: settings,
+		parser:   jwt.NewParser(opts...),
+	}
+}
+
+// roles returns the roles listed in the claims. Both a top-level roles claim and Keycloak's realm_access.roles
+// claim are supported.
+func roles(claims jwt.MapClaims) []string {
+	var result []string
+
+	appendRoles := func(value interface{}) {
+		list, _ := value.([]interface{})
+		for _, role := range list {
+			if s, ok := role.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+
+	appendRoles(claims["roles"])
+	if realmAccess, ok := claims["realm_access"].(map[string]interface{}); ok {
+		appendRoles(realmAccess["roles"])
+	}
+
+	return result
+}
+
+// Authenticate validates the bearer token in the request and returns the caller's identity.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = a.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		return a.keys.Key(r.Context(), keyID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	username, _ := claims[a.settings.UsernameClaim].(string)
+	if username == "" {
+		return nil, errors.New("invalid token: the username claim is missing")
+	}
+
+	identity := &Identity{
+		Username: clients.StripUsernameSuffix(username),
+		Roles:    roles(claims),
+	}
+	for _, role := range identity.Roles {
+		if role == a.settings.AdminRole {
+			identity.Admin = true
+		}
+	}
+
+	return identity, nil
+}
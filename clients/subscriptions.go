@@ -85,3 +85,68 @@ func (c *Subscriptions) AddUserUpdate(ctx context.Context, username string, upda
 
 	return serviceError(response.Error)
 }
+
+// GetUserSubscription returns the user's current subscription, including the quotas and usages associated with it.
+func (c *Subscriptions) GetUserSubscription(ctx context.Context, username string) (*qms.Subscription, error) {
+	requestURL := c.subscriptionsURL("summary", StripUsernameSuffix(username))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to build the request for %s", requestURL)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to send the request to %s", requestURL)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	var response qms.SubscriptionResponse
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message := fmt.Sprintf("%s returned %d", requestURL, resp.StatusCode)
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && response.Error.GetMessage() != "" {
+			message = fmt.Sprintf("%s: %s", message, response.Error.GetMessage())
+		}
+		return nil, NewHTTPError(resp.StatusCode, message)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the response body from %s", requestURL)
+	}
+
+	if err = serviceError(response.Error); err != nil {
+		return nil, err
+	}
+
+	if response.Subscription == nil {
+		return nil, NewHTTPError(http.StatusNotFound, fmt.Sprintf("no subscription found for %s", username))
+	}
+
+	return response.Subscription, nil
+}
+
+// QuotaAndUsage returns the quota and usage values for a resource type in a subscription. The last return value is
+// false if the subscription doesn't have a quota for the resource type.
+func QuotaAndUsage(subscription *qms.Subscription, resourceType string) (float64, float64, bool) {
+	var (
+		quota, usage float64
+		found        bool
+	)
+
+	for _, q := range subscription.GetQuotas() {
+		if q.GetResourceType().GetName() == resourceType {
+			quota = q.GetQuota()
+			found = true
+			break
+		}
+	}
+
+	for _, u := range subscription.GetUsages() {
+		if u.GetResourceType().GetName() == resourceType {
+			usage = u.GetUsage()
+			break
+		}
+	}
+
+	return quota, usage, found
+}
@@ -211,3 +211,80 @@ func TestServiceError(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUserSubscription(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantErr    bool
+		wantStatus int
+		wantID     string
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   `{"subscription":{"uuid":"some-uuid","quotas":[{"quota":100,"resource_type":{"name":"cpu.hours"}}]}}`,
+			wantID: "some-uuid",
+		},
+		{
+			name:       "missing subscription",
+			status:     http.StatusOK,
+			body:       `{}`,
+			wantErr:    true,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "error envelope on a 2xx response",
+			status:     http.StatusOK,
+			body:       `{"error":{"error_code":"NOT_FOUND","status_code":404,"message":"user name not found"}}`,
+			wantErr:    true,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "non-2xx status",
+			status:     http.StatusInternalServerError,
+			body:       `boom`,
+			wantErr:    true,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			c, err := SubscriptionsClient(srv.URL)
+			if err != nil {
+				t.Fatalf("building the client: %s", err)
+			}
+
+			subscription, err := c.GetUserSubscription(context.Background(), "someuser@example.org")
+			if want := "/summary/someuser"; gotPath != want {
+				t.Errorf("path = %s, want %s", gotPath, want)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				if got := GetStatusCode(err); got != tt.wantStatus {
+					t.Errorf("status code = %d, want %d", got, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if subscription.GetUuid() != tt.wantID {
+				t.Errorf("subscription ID = %q, want %q", subscription.GetUuid(), tt.wantID)
+			}
+		})
+	}
+}
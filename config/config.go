@@ -0,0 +1,431 @@
+// Package config loads and validates the settings for resource-usage-api.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/mitchellh/mapstructure"
+)
+
+// DB contains the database settings.
+type DB struct {
+	URI              string        `koanf:"uri" redact:"true"`
+	StatementTimeout time.Duration `koanf:"statementtimeout"`
+
+	// The time zone of the timestamps without time zones in the DE database. The database server's TimeZone setting
+	// is used if it's empty.
+	TimeZone string `koanf:"timezone"`
+
+	Pool struct {
+		MaxOpen     int           `koanf:"maxopen"`
+		MaxIdle     int           `koanf:"maxidle"`
+		MaxLifetime time.Duration `koanf:"maxlifetime"`
+		MaxIdleTime time.Duration `koanf:"maxidletime"`
+	} `koanf:"pool"`
+
+	Connect struct {
+		Timeout        time.Duration `koanf:"timeout"`
+		InitialBackoff time.Duration `koanf:"initialbackoff"`
+		MaxBackoff     time.Duration `koanf:"maxbackoff"`
+	} `koanf:"connect"`
+}
+
+// AMQP contains the settings for the AMQP broker.
+type AMQP struct {
+	URI string `koanf:"uri" redact:"true"`
+
+	Exchange struct {
+		Name string `koanf:"name"`
+		Type string `koanf:"type"`
+	} `koanf:"exchange"`
+
+	Queue         string `koanf:"queue"`
+	Reconnect     bool   `koanf:"reconnect"`
+	Prefetch      int    `koanf:"prefetch"`
+	Workers       int    `koanf:"workers"`
+	QueueDepth    int    `koanf:"queuedepth"`
+	QuarantineKey string `koanf:"quarantinekey"`
+}
+
+// Notifications contains the quota notification settings.
+type Notifications struct {
+	Enabled    bool      `koanf:"enabled"`
+	Thresholds []float64 `koanf:"thresholds"`
+}
+
+// Enforcement contains the quota enforcement settings.
+type Enforcement struct {
+	Enabled       bool          `koanf:"enabled"`
+	GracePeriod   time.Duration `koanf:"graceperiod"`
+	SweepInterval time.Duration `koanf:"sweepinterval"`
+	ExemptPlans   []string      `koanf:"exemptplans"`
+	Endpoint      string        `koanf:"endpoint"`
+	RoutingKey    string        `koanf:"routingkey"`
+}
+
+// Finalization contains the settings for finalizing usage that had to be deferred.
+type Finalization struct {
+	Interval    time.Duration `koanf:"interval"`
+	RetryDelay  time.Duration `koanf:"retrydelay"`
+	MaxAttempts int           `koanf:"maxattempts"`
+	BatchSize   int           `koanf:"batchsize"`
+}
+
+// Auth contains the settings for authenticating requests to the HTTP API.
+type Auth struct {
+	Enabled       bool   `koanf:"enabled"`
+	JWKSURL       string `koanf:"jwksurl"`
+	JWKSFile      string `koanf:"jwksfile"`
+	Issuer        string `koanf:"issuer"`
+	Audience      string `koanf:"audience"`
+	UsernameClaim string `koanf:"usernameclaim"`
+	AdminRole     string `koanf:"adminrole"`
+}
+
+// Group is a group of users whose usage is summed, such as a lab that shares an allocation. Groups can also be
+// stored in the database.
+type Group struct {
+	Members []string `koanf:"members"`
+
+	// The number of CPU hours the group's members can use between them. Zero means the group doesn't have a quota.
+	Quota float64 `koanf:"quota"`
+}
+
+// Config contains all of the settings for resource-usage-api. The koanf tags are the configuration keys, so for
+// example Enforcement.GracePeriod is set with enforcement.graceperiod in the configuration file or with the
+// DISCOENV_ENFORCEMENT_GRACEPERIOD environment variable.
+type Config struct {
+	Listen struct {
+		Port int `koanf:"port"`
+	} `koanf:"listen"`
+
+	Log struct {
+		Level string `koanf:"level"`
+	} `koanf:"log"`
+
+	DB   DB   `koanf:"db"`
+	AMQP AMQP `koanf:"amqp"`
+
+	Users struct {
+		Domain string `koanf:"domain"`
+	} `koanf:"users"`
+
+	QMS struct {
+		Enabled bool `koanf:"enabled"`
+	} `koanf:"qms"`
+
+	Usage struct {
+		// An empty routing key disables usage events.
+		RoutingKey string `koanf:"routingkey"`
+	} `koanf:"usage"`
+
+	DataUsage struct {
+		BaseURL string `koanf:"baseurl"`
+	} `koanf:"datausage"`
+
+	Subscriptions struct {
+		BaseURI string `koanf:"baseuri"`
+	} `koanf:"subscriptions"`
+
+	Auth          Auth          `koanf:"auth"`
+	Notifications Notifications `koanf:"notifications"`
+	Enforcement   Enforcement   `koanf:"enforcement"`
+	Finalization  Finalization  `koanf:"finalization"`
+
+	// Groups are keyed by name.
+	Groups map[string]Group `koanf:"groups"`
+}
+
+// Default returns the configuration used for settings that aren't set anywhere else.
+func Default() *Config {
+	var c Config
+
+	c.Listen.Port = 60000
+	c.Log.Level = "info"
+
+	c.DB.Pool.MaxOpen = 10
+	c.DB.Pool.MaxIdle = 2
+	c.DB.Pool.MaxLifetime = 30 * time.Minute
+	c.DB.Pool.MaxIdleTime = time.Minute
+	c.DB.Connect.Timeout = 5 * time.Minute
+	c.DB.Connect.InitialBackoff = time.Second
+	c.DB.Connect.MaxBackoff = 30 * time.Second
+
+	c.AMQP.Queue = "resource-usage-api"
+	c.AMQP.Prefetch = 10
+	c.AMQP.Workers = 4
+	c.AMQP.QueueDepth = 10
+	c.AMQP.QuarantineKey = "resource-usage-api.quarantine"
+
+	c.Usage.RoutingKey = "qms.usages"
+	c.DataUsage.BaseURL = "http://data-usage-api"
+	c.Subscriptions.BaseURI = "http://subscriptions"
+
+	c.Auth.UsernameClaim = "preferred_username"
+	c.Auth.AdminRole = "admin"
+
+	c.Enforcement.SweepInterval = 5 * time.Minute
+	c.Enforcement.RoutingKey = "qms.overages"
+
+	c.Finalization.Interval = time.Minute
+	c.Finalization.RetryDelay = time.Minute
+	c.Finalization.MaxAttempts = 10
+	c.Finalization.BatchSize = 100
+
+	return &c
+}
+
+// stringToTrimmedSliceHook splits strings into slices on commas, ignoring the whitespace around each value, so that
+// lists can be given in environment variables.
+func stringToTrimmedSliceHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Slice {
+		return data, nil
+	}
+
+	values := []string{}
+	for _, field := range strings.Split(data.(string), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values, nil
+}
+
+// Load returns the configuration in k, using the defaults for settings that k doesn't contain. The configuration
+// isn't validated.
+func Load(k *koanf.Koanf) (*Config, error) {
+	c := Default()
+
+	err := k.UnmarshalWithConf("", c, koanf.UnmarshalConf{
+		DecoderConfig: &mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				mapstructure.StringToTimeDurationHookFunc(),
+				stringToTrimmedSliceHook,
+			),
+			Result:           c,
+			WeaklyTypedInput: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// logLevels are the log levels that can be configured.
+var logLevels = map[string]bool{
+	"trace": true,
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+	"fatal": true,
+	"panic": true,
+}
+
+// validateURL returns an error if value isn't an absolute URL.
+func validateURL(key, value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("%s must be an absolute URL", key)
+	}
+	return nil
+}
+
+// Validate checks the configuration, returning an error that describes every problem that was found.
+func (c *Config) Validate() error {
+	var errs []error
+
+	required := func(key, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", key))
+		}
+	}
+	atLeast := func(key string, value, min int) {
+		if value < min {
+			errs = append(errs, fmt.Errorf("%s must be at least %d", key, min))
+		}
+	}
+	positive := func(key string, value time.Duration) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration", key))
+		}
+	}
+	nonNegative := func(key string, value time.Duration) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", key))
+		}
+	}
+	validURL := func(key, value string) {
+		if err := validateURL(key, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.Listen.Port < 1 || c.Listen.Port > 65535 {
+		errs = append(errs, errors.New("listen.port must be between 1 and 65535"))
+	}
+	if !logLevels[c.Log.Level] {
+		errs = append(errs, errors.New("log.level must be one of trace, debug, info, warn, error, fatal, or panic"))
+	}
+
+	required("db.uri", c.DB.URI)
+	nonNegative("db.statementtimeout", c.DB.StatementTimeout)
+	if _, err := time.LoadLocation(c.DB.TimeZone); err != nil && c.DB.TimeZone != "" {
+		errs = append(errs, fmt.Errorf("db.timezone must be a time zone name such as America/Phoenix, got %q", c.DB.TimeZone))
+	}
+	atLeast("db.pool.maxopen", c.DB.Pool.MaxOpen, 0)
+	atLeast("db.pool.maxidle", c.DB.Pool.MaxIdle, 0)
+	nonNegative("db.pool.maxlifetime", c.DB.Pool.MaxLifetime)
+	nonNegative("db.pool.maxidletime", c.DB.Pool.MaxIdleTime)
+	nonNegative("db.connect.timeout", c.DB.Connect.Timeout)
+	positive("db.connect.initialbackoff", c.DB.Connect.InitialBackoff)
+	if c.DB.Connect.MaxBackoff < c.DB.Connect.InitialBackoff {
+		errs = append(errs, errors.New("db.connect.maxbackoff must be at least db.connect.initialbackoff"))
+	}
+
+	required("amqp.uri", c.AMQP.URI)
+	required("amqp.exchange.name", c.AMQP.Exchange.Name)
+	required("amqp.exchange.type", c.AMQP.Exchange.Type)
+	required("amqp.queue", c.AMQP.Queue)
+	required("amqp.quarantinekey", c.AMQP.QuarantineKey)
+	atLeast("amqp.prefetch", c.AMQP.Prefetch, 0)
+	atLeast("amqp.workers", c.AMQP.Workers, 1)
+	atLeast("amqp.queuedepth", c.AMQP.QueueDepth, 1)
+
+	required("users.domain", c.Users.Domain)
+	validURL("datausage.baseurl", c.DataUsage.BaseURL)
+	validURL("subscriptions.baseuri", c.Subscriptions.BaseURI)
+
+	if c.Auth.Enabled {
+		if (c.Auth.JWKSURL == "") == (c.Auth.JWKSFile == "") {
+			errs = append(errs, errors.New("exactly one of auth.jwksurl or auth.jwksfile must be set"))
+		} else if c.Auth.JWKSURL != "" {
+			validURL("auth.jwksurl", c.Auth.JWKSURL)
+		}
+		required("auth.usernameclaim", c.Auth.UsernameClaim)
+		required("auth.adminrole", c.Auth.AdminRole)
+	}
+
+	for _, threshold := range c.Notifications.Thresholds {
+		if threshold <= 0 {
+			errs = append(errs, fmt.Errorf("notifications.thresholds must be positive percentages, got %g", threshold))
+		}
+	}
+
+	nonNegative("enforcement.graceperiod", c.Enforcement.GracePeriod)
+	positive("enforcement.sweepinterval", c.Enforcement.SweepInterval)
+	if c.Enforcement.Endpoint != "" {
+		validURL("enforcement.endpoint", c.Enforcement.Endpoint)
+	} else if c.Enforcement.Enabled {
+		required("enforcement.routingkey", c.Enforcement.RoutingKey)
+	}
+
+	for name, group := range c.Groups {
+		if len(group.Members) == 0 {
+			errs = append(errs, fmt.Errorf("groups.%s.members must list at least one user", name))
+		}
+		if group.Quota < 0 {
+			errs = append(errs, fmt.Errorf("groups.%s.quota must not be negative", name))
+		}
+	}
+
+	positive("finalization.interval", c.Finalization.Interval)
+	nonNegative("finalization.retrydelay", c.Finalization.RetryDelay)
+	atLeast("finalization.maxattempts", c.Finalization.MaxAttempts, 1)
+	atLeast("finalization.batchsize", c.Finalization.BatchSize, 1)
+
+	return errors.Join(errs...)
+}
+
+// passwordPattern matches the password in a connection string made up of key/value pairs.
+var passwordPattern = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// redact hides the password in a URI or connection string.
+func redact(value string) string {
+	if parsed, err := url.Parse(value); err == nil && parsed.Scheme != "" {
+		return parsed.Redacted()
+	}
+	return passwordPattern.ReplaceAllString(value, "${1}xxxxx")
+}
+
+// printMap writes the entries of a map of structs in key order, descending into each struct.
+func printMap(w io.Writer, prefix string, v reflect.Value) error {
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := printFields(w, prefix+key+".", v.MapIndex(reflect.ValueOf(key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printFields writes the fields of a struct as key/value pairs, descending into nested structs and maps of structs.
+func printFields(w io.Writer, prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("koanf")
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			if err := printFields(w, key+".", value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if value.Kind() == reflect.Map && value.Type().Elem().Kind() == reflect.Struct {
+			if err := printMap(w, key+".", value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var formatted string
+		switch actual := value.Interface().(type) {
+		case time.Duration:
+			formatted = actual.String()
+		case string:
+			formatted = actual
+			if field.Tag.Get("redact") == "true" {
+				formatted = redact(actual)
+			}
+		default:
+			if value.Kind() == reflect.Slice {
+				parts := make([]string, value.Len())
+				for j := range parts {
+					parts[j] = fmt.Sprint(value.Index(j).Interface())
+				}
+				formatted = strings.Join(parts, ",")
+			} else {
+				formatted = fmt.Sprint(actual)
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s=%s\n", key, formatted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print writes the configuration to w as one key=value pair per line, with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	return printFields(w, "", reflect.ValueOf(c).Elem())
+}
@@ -0,0 +1,164 @@
+package cpuhours
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/p/go/ptypes"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInvalidAdjustment is returned when an adjustment request can't be carried out as given.
+var ErrInvalidAdjustment = errors.New("invalid usage adjustment")
+
+// The event types recorded for each of the adjustment operations.
+var adjustmentEventTypes = map[string]db.EventType{
+	"ADD":      db.CPUHoursAdd,
+	"SUBTRACT": db.CPUHoursSubtract,
+	"RESET":    db.CPUHoursReset,
+}
+
+// AdjustmentRequest describes a manual adjustment to a user's CPU hours.
+type AdjustmentRequest struct {
+	// The user whose usage is being adjusted, including the domain suffix.
+	Username string
+
+	// One of ADD, SUBTRACT, or RESET.
+	Operation string
+
+	// The number of CPU hours to add or subtract. Must be zero for RESET.
+	Amount float64
+
+	// Why the adjustment is being made.
+	Reason string
+
+	// Who is making the adjustment.
+	Actor string
+}
+
+// adjustmentUpdate returns the QMS update that applies the adjustment. QMS only understands adding to and setting
+// usage values, so subtractions are sent as negative additions and resets set the usage to zero.
+func adjustmentUpdate(adjustment *db.UsageAdjustment) (*qms.Update, error) {
+	metajson, err := json.Marshal(adjustment)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &qms.Update{
+		ValueType:     "usages",
+		EffectiveDate: ptypes.Now(),
+		ResourceType: &qms.ResourceType{
+			Name: clients.ResourceTypeCPUHours,
+			Unit: "cpu hours",
+		},
+		User: &qms.QMSUser{
+			Username: adjustment.Username,
+		},
+		Metadata: string(metajson),
+	}
+
+	switch adjustment.EventType {
+	case db.CPUHoursAdd:
+		update.Operation = &qms.UpdateOperation{Name: "ADD"}
+		update.Value = adjustment.Amount
+	case db.CPUHoursSubtract:
+		update.Operation = &qms.UpdateOperation{Name: "ADD"}
+		update.Value = -adjustment.Amount
+	case db.CPUHoursReset:
+		update.Operation = &qms.UpdateOperation{Name: "SET"}
+		update.Value = 0
+	}
+
+	return update, nil
+}
+
+// Adjust records a manual adjustment to a user's CPU hours and forwards it to QMS. The adjustment is recorded as
+// pending before it's sent, so that it isn't lost if QMS accepts it and recording it fails afterwards. It's marked as
+// applied and added to the audit log once QMS accepts it, and marked as failed along with the error otherwise.
+func (c *CPUHours) Adjust(context context.Context, req *AdjustmentRequest) (*db.UsageAdjustment, error) {
+	operation := strings.ToUpper(req.Operation)
+	eventType, ok := adjustmentEventTypes[operation]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("%w: the operation must be one of ADD, SUBTRACT, or RESET", ErrInvalidAdjustment)
+	case strings.TrimSpace(req.Reason) == "":
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidAdjustment)
+	case req.Actor == "":
+		return nil, fmt.Errorf("%w: the actor is required", ErrInvalidAdjustment)
+	case eventType == db.CPUHoursReset && req.Amount != 0:
+		return nil, fmt.Errorf("%w: the amount must be omitted for RESET", ErrInvalidAdjustment)
+	case eventType != db.CPUHoursReset && req.Amount <= 0:
+		return nil, fmt.Errorf("%w: the amount must be positive", ErrInvalidAdjustment)
+	}
+
+	msgLog := log.WithFields(logrus.Fields{"context": "adjusting usage", "user": req.Username, "actor": req.Actor}).WithContext(context)
+
+	user, err := c.store.UserByUsername(context, req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	adjustment := &db.UsageAdjustment{
+		UserID:       user.ID,
+		Username:     user.Username,
+		ResourceType: clients.ResourceTypeCPUHours,
+		EventType:    eventType,
+		Amount:       req.Amount,
+		Reason:       strings.TrimSpace(req.Reason),
+		Actor:        req.Actor,
+	}
+	if err = c.store.AddUsageAdjustment(context, adjustment); err != nil {
+		return nil, err
+	}
+
+	update, err := adjustmentUpdate(adjustment)
+	if err != nil {
+		return nil, err
+	}
+
+	msgLog.Infof("sending %s adjustment %s of %f to QMS: %s", operation, adjustment.ID, req.Amount, adjustment.Reason)
+	if err = c.subscriptions.AddUserUpdate(context, user.Username, update); err != nil {
+		if failErr := c.store.FailUsageAdjustment(context, adjustment.ID, err.Error()); failErr != nil {
+			msgLog.WithError(failErr).Errorf("unable to mark adjustment %s as failed", adjustment.ID)
+		}
+		return nil, err
+	}
+
+	details, err := json.Marshal(map[string]interface{}{
+		"adjustment_id": adjustment.ID,
+		"reason":        adjustment.Reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.store.WithTx(context, func(tx Store) error {
+		if err := tx.CompleteUsageAdjustment(context, adjustment.ID); err != nil {
+			return err
+		}
+
+		return tx.AddAuditEntry(context, &db.AuditEntry{
+			UserID:       user.ID,
+			Username:     user.Username,
+			ResourceType: adjustment.ResourceType,
+			Source:       db.AuditSourceAdjustment,
+			Operation:    operation,
+			Amount:       adjustment.Amount,
+			Actor:        adjustment.Actor,
+			Details:      details,
+		})
+	})
+	if err != nil {
+		msgLog.WithError(err).Errorf("QMS accepted adjustment %s, but it couldn't be marked as applied", adjustment.ID)
+		return nil, fmt.Errorf("adjustment %s was sent to QMS but is still recorded as pending: %w", adjustment.ID, err)
+	}
+
+	adjustment.Status = db.AdjustmentApplied
+	return adjustment, nil
+}
@@ -0,0 +1,35 @@
+package cpuhours
+
+import (
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// The number of significant digits kept when calculating CPU hours.
+const precision = 15
+
+// Calculate returns the CPU hours charged for reserving the given number of millicores for the given amount of time.
+// It's used both to charge for analyses and to estimate what an analysis will cost, so that estimates match what's
+// actually charged.
+func Calculate(millicoresReserved int64, duration time.Duration) (*apd.Decimal, error) {
+	timeSpent, err := apd.New(0, 0).SetFloat64(duration.Hours())
+	if err != nil {
+		return nil, err
+	}
+
+	mcReserved := apd.New(0, 0).SetInt64(millicoresReserved)
+	cpuHours := apd.New(0, 0)
+	mc2cores := apd.New(1000, 0)
+
+	bc := apd.BaseContext.WithPrecision(precision)
+	if _, err = bc.Mul(cpuHours, mcReserved, timeSpent); err != nil {
+		return nil, err
+	}
+
+	if _, err = bc.Quo(cpuHours, cpuHours, mc2cores); err != nil {
+		return nil, err
+	}
+
+	return cpuHours, nil
+}
@@ -0,0 +1,31 @@
+package cpuhours
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		millicores int64
+		duration   time.Duration
+		expected   string
+	}{
+		{1000, time.Hour, "1"},
+		{4000, 90 * time.Minute, "6.0"},
+		{250, 2 * time.Hour, "0.5"},
+		{1500, 20 * time.Minute, "0.500000000000"},
+		{0, time.Hour, "0"},
+		{1000, 0, "0"},
+	}
+
+	for _, test := range tests {
+		cpuHours, err := Calculate(test.millicores, test.duration)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if cpuHours.String() != test.expected {
+			t.Errorf("%d millicores for %s: expected %s, got %s", test.millicores, test.duration, test.expected, cpuHours.String())
+		}
+	}
+}
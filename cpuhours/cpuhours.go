@@ -3,163 +3,232 @@ package cpuhours
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/messaging/v9"
 	"github.com/cyverse-de/p/go/ptypes"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/amqp"
 	"github.com/cyverse-de/resource-usage-api/clients"
 	"github.com/cyverse-de/resource-usage-api/db"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/guregu/null"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "cpuhours"})
 
+// Hook is called after a usage update for a user has been accepted by QMS.
+type Hook func(context context.Context, username string, res *CalculationResult) error
+
+// AuditActor is the actor recorded in the audit log for usage calculated by this service.
+const AuditActor = "resource-usage-api"
+
 type CPUHours struct {
-	db            *db.Database
-	subscriptions *clients.Subscriptions
+	store         Store
+	subscriptions QMSClient
+	hooks         []Hook
+	auditSource   db.AuditSource
 }
 
 type CalculationResult struct {
 	CPUHours  *apd.Decimal
 	Analysis  *db.Analysis
+	Step      *db.AnalysisStep
+	Username  string
 	BasisTime time.Time
 	CalcTime  time.Time
+
+	// EndDateFallback is true if the analysis didn't have an end date, so the
+	// calculation time was substituted for it.
+	EndDateFallback bool
+
+	// PeriodSplit is true if the step's usage spans the start or end of the
+	// user's current subscription period, in which case the result only
+	// covers the part of the usage in a single period.
+	PeriodSplit bool `json:",omitempty"`
+
+	// remaining is true if there's usage after the end of the period that
+	// the result covers, which is charged separately.
+	remaining bool
 }
 
-func New(db *db.Database, subscriptions *clients.Subscriptions) *CPUHours {
+// ErrEndDateMissing is returned when usage can't be finalized yet because the
+// analysis doesn't have an end date.
+var ErrEndDateMissing = errors.New("the analysis does not have an end date yet")
+
+// New returns a *CPUHours that reads and records usage in the store and sends it to QMS using the subscriptions
+// client. DatabaseStore returns the store used in production.
+func New(store Store, subscriptions QMSClient) *CPUHours {
 	return &CPUHours{
-		db:            db,
+		store:         store,
 		subscriptions: subscriptions,
+		auditSource:   db.AuditSourceCalculation,
+	}
+}
+
+// WithAuditSource returns a copy of c that records the usage it calculates
+// in the audit log as coming from the given source. The copy shares c's
+// hooks.
+func (c *CPUHours) WithAuditSource(source db.AuditSource) *CPUHours {
+	scoped := *c
+	scoped.auditSource = source
+	return &scoped
+}
+
+// AddHook registers a function to be called after each usage update. Hooks
+// should be added before any usage is calculated.
+func (c *CPUHours) AddHook(hook Hook) {
+	c.hooks = append(c.hooks, hook)
+}
+
+// runHooks calls each of the registered hooks. A failing hook doesn't affect
+// the usage update or the other hooks, so errors are only logged.
+func (c *CPUHours) runHooks(context context.Context, username string, res *CalculationResult) {
+	for _, hook := range c.hooks {
+		if err := hook(context, username, res); err != nil {
+			log.WithContext(context).WithError(err).Error("usage update hook failed")
+		}
 	}
 }
 
-// CPUHoursForAnalysis returns the CPU hours total for the analysis as a decimal value.
-func (c *CPUHours) CPUHoursForAnalysis(context context.Context, analysisID string) (CalculationResult, error) {
+// CPUHoursForStep returns the CPU hours total for a step of an analysis as a decimal value. Each step of a multi-step
+// analysis is accounted for separately, using its own start and end dates and reservation. If the step doesn't have
+// an end date yet, ErrEndDateMissing is returned unless allowFallback is true, in which case a substitute end date
+// is used and the result is flagged accordingly.
+func (c *CPUHours) CPUHoursForStep(context context.Context, externalID string, allowFallback bool) (CalculationResult, error) {
 	var (
 		basisTime time.Time
 		calcTime  time.Time
 		analysis  *db.Analysis
+		step      *db.AnalysisStep
 		err       error
 		res       CalculationResult
 	)
-	msgLog := log.WithFields(logrus.Fields{"context": "calculating CPU hours", "analysisID": analysisID})
+	msgLog := log.WithFields(logrus.Fields{"context": "calculating CPU hours", "externalID": externalID})
 
-	msgLog.Debug("getting millicores reserved")
-	millicoresReserved, err := c.db.MillicoresReserved(context, analysisID)
+	msgLog.Debug("getting step info and locking row")
+	step, err = c.store.StepByExternalID(context, externalID)
 	if err != nil {
 		return res, err
 	}
-	msgLog.Debug("done getting millicores reserved")
+	msgLog.Debug("done getting step info")
 
-	for i := 0; i < 5; i++ { // Try five times, then use time.Now().UTC() instead
-		msgLog.Debug("getting analysis info and locking row")
-		analysis, err = c.db.AnalysisWithoutUser(context, analysisID)
-		if err != nil {
-			return res, err
-		}
-		msgLog.Debug("done getting analysis info")
+	msgLog = msgLog.WithFields(logrus.Fields{"analysisID": step.JobID, "stepNumber": step.StepNumber})
 
-		if !analysis.StartDate.Valid {
-			return res, fmt.Errorf("start date is null")
-		}
+	msgLog.Debug("getting analysis info and locking row")
+	analysis, err = c.store.AnalysisWithoutUser(context, step.JobID)
+	if err != nil {
+		return res, err
+	}
+	msgLog.Debug("done getting analysis info")
 
-		// It's possible for this to be reached before the database is updated with the actual
-		// end date. If that's the case, wait a bit and try again.
-		//
-		// We drop and restart the transaction here to avoid lock
-		// issues and allow the end date to get set by other processes
-		if !analysis.EndDate.Valid {
-			if err := c.db.Rollback(); err != nil {
-				msgLog.WithError(err).Error("failed to rollback transaction")
-			}
-			time.Sleep(5 * time.Second)
-			c.db.Begin(context) // nolint: errcheck
-			continue
-
-		} else {
-			calcTime = analysis.EndDate.Time.UTC()
-			break
-		}
+	if !step.StartDate.Valid && !analysis.StartDate.Valid && !analysis.AccountingStart.Valid {
+		return res, fmt.Errorf("start date is null")
 	}
 
 	res.Analysis = analysis
+	res.Step = step
 
-	if calcTime.IsZero() {
-		calcTime = time.Now().UTC()
-	}
-
-	// Start calculation at the most recent of StartTime or UsageLastUpdate
-	// calculate to EndDate or now, whichever is earlier
-	// so start -> now, last update -> now, start -> end time already past, or last update -> end time already past
-	// then update last update time to the now value that was used
-	basisTime = analysis.StartDate.Time.UTC()
-	if analysis.UsageLastUpdate.Valid && analysis.UsageLastUpdate.Time.UTC().After(basisTime) {
-		basisTime = analysis.UsageLastUpdate.Time.UTC()
+	basisTime, calcTime, res.EndDateFallback, err = usageWindow(step, analysis, allowFallback, time.Now())
+	if err != nil {
+		return res, err
 	}
 
 	res.BasisTime = basisTime
 	res.CalcTime = calcTime
 	msgLog.Infof("basis date: %s, end date: %s", basisTime.String(), calcTime.String())
 
-	timeSpent, err := apd.New(0, 0).SetFloat64(calcTime.Sub(basisTime).Hours())
+	cpuHours, err := Calculate(step.MillicoresReserved, calcTime.Sub(basisTime))
 	if err != nil {
 		return res, err
 	}
 
-	mcReserved := apd.New(0, 0).SetInt64(millicoresReserved)
-	cpuHours := apd.New(0, 0)
-	mc2cores := apd.New(1000, 0)
+	msgLog.Infof(
+		"run time is %f hours; millicores reserved is %d; cpu hours is %s",
+		calcTime.Sub(basisTime).Hours(),
+		step.MillicoresReserved,
+		cpuHours.String(),
+	)
 
-	bc := apd.BaseContext.WithPrecision(15)
-	_, err = bc.Mul(cpuHours, mcReserved, timeSpent)
+	res.CPUHours = cpuHours
+
+	return res, nil
+}
+
+// limitToPeriod narrows the calculation result to the part of the usage in a
+// single subscription period when the usage spans the start or end of the
+// user's current subscription period. The usage after the end of that period
+// is left for a later calculation, so that each period is charged in its own
+// transaction and a failure partway through doesn't charge the earlier periods
+// again.
+func (c *CPUHours) limitToPeriod(context context.Context, res *CalculationResult) error {
+	username, err := c.store.Username(context, res.Analysis.UserID)
 	if err != nil {
-		return res, err
+		return err
 	}
+	res.Username = username
 
-	_, err = bc.Quo(cpuHours, cpuHours, mc2cores)
+	boundaries, err := c.subscriptionBoundaries(context, username)
 	if err != nil {
-		return res, err
+		log.WithContext(context).WithError(err).Error("Failed to get the subscription period")
+		return err
 	}
 
-	msgLog.Infof("run time is %s hours; millicores reserved is %s; cpu hours is %s", timeSpent.String(), mcReserved.String(), cpuHours.String())
-
-	err = c.db.SetUsageLastUpdate(context, analysisID, calcTime)
+	charges, err := SplitByPeriod(res.CPUHours, res.BasisTime, res.CalcTime, boundaries...)
 	if err != nil {
-		return res, err
+		return err
 	}
 
-	res.CPUHours = cpuHours
+	// The usage after a boundary that was already charged up to is still
+	// part of a split.
+	for _, boundary := range boundaries {
+		if boundary.Equal(res.BasisTime) {
+			res.PeriodSplit = true
+		}
+	}
+	if len(charges) > 1 {
+		res.PeriodSplit = true
+		res.remaining = true
+		res.CalcTime = charges[0].End
+		res.CPUHours = charges[0].CPUHours
+	}
 
-	return res, nil
+	return nil
 }
 
-func (c *CPUHours) addEvent(context context.Context, res CalculationResult) error {
-	var err error
-	analysis := res.Analysis
-	cpuHours := res.CPUHours
+// addEvent sends the usage in the calculation result to QMS. Usage that was
+// split at a subscription period boundary is effective at the start of the
+// part of the usage that it covers, so that it's charged to the period it was
+// used in.
+func (c *CPUHours) addEvent(context context.Context, res *CalculationResult) error {
+	username := res.Username
+	msgLog := log.WithFields(logrus.Fields{"context": "adding event", "analysisID": res.Analysis.ID})
 
-	floatValue, err := cpuHours.Float64()
+	metajson, err := json.Marshal(res)
 	if err != nil {
 		return err
 	}
 
-	username, err := c.db.Username(context, analysis.UserID)
+	floatValue, err := res.CPUHours.Float64()
 	if err != nil {
 		return err
 	}
 
-	metajson, err := json.Marshal(res)
-	if err != nil {
-		return err
+	// Usage that isn't split is effective when it's recorded, as it always
+	// has been.
+	effectiveDate := ptypes.Now()
+	if res.PeriodSplit {
+		effectiveDate = ptypes.New(res.BasisTime)
 	}
 
 	update := &qms.Update{
 		ValueType:     "usages",
 		Value:         floatValue,
-		EffectiveDate: ptypes.Now(),
+		EffectiveDate: effectiveDate,
 		Operation: &qms.UpdateOperation{
 			Name: "ADD",
 		},
@@ -173,9 +242,7 @@ func (c *CPUHours) addEvent(context context.Context, res CalculationResult) erro
 		Metadata: string(metajson),
 	}
 
-	msgLog := log.WithFields(logrus.Fields{"context": "adding event", "analysisID": analysis.ID})
-
-	msgLog.Debugf("adding cpu usage event of %f for %s", floatValue, username)
+	msgLog.Debugf("adding cpu usage event of %f for %s effective %s", floatValue, username, effectiveDate.AsTime())
 	if err = c.subscriptions.AddUserUpdate(context, username, update); err != nil {
 		msgLog.WithError(err).Error("Failed to add CPU usage event")
 		return err
@@ -185,44 +252,204 @@ func (c *CPUHours) addEvent(context context.Context, res CalculationResult) erro
 	return nil
 }
 
-func (c *CPUHours) CalculateForAnalysisByID(context context.Context, analysisID string) error {
+// CalculateForStep calculates the usage for a step of an analysis, sends it to QMS, and records that the step's
+// usage has been charged up to the end of the calculation. Only the usage in the first subscription period is
+// charged when the usage spans a period boundary.
+func (c *CPUHours) CalculateForStep(context context.Context, externalID string, allowFallback bool) (CalculationResult, error) {
 	var (
 		res CalculationResult
 		err error
 	)
 
-	res, err = c.CPUHoursForAnalysis(context, analysisID)
+	res, err = c.CPUHoursForStep(context, externalID, allowFallback)
 	if err != nil {
-		return err
+		return res, err
 	}
 
-	return c.addEvent(context, res)
-}
+	if err = c.limitToPeriod(context, &res); err != nil {
+		return res, err
+	}
 
-func (c *CPUHours) CalculateForAnalysis(context context.Context, externalID string) error {
-	log.Debug("getting analysis id")
+	// Nothing is sent to QMS or audited when there's nothing to charge, such
+	// as when an update for a step that was already charged is handled again.
+	charged := !res.CPUHours.IsZero()
+	if charged {
+		if err = c.addEvent(context, &res); err != nil {
+			return res, err
+		}
+	}
+
+	if err = c.store.SetStepUsageLastUpdate(context, externalID, res.CalcTime); err != nil {
+		return res, err
+	}
 
-	// We'll do this lookup outside the transaction to limit the lock time
-	analysisID, err := c.db.GetAnalysisIDByExternalID(context, externalID)
+	if err = c.store.SetUsageLastUpdate(context, res.Step.JobID, res.CalcTime); err != nil {
+		return res, err
+	}
+
+	if !charged {
+		return res, nil
+	}
+	return res, c.audit(context, &res)
+}
+
+// audit records a calculation result in the audit log.
+func (c *CPUHours) audit(context context.Context, res *CalculationResult) error {
+	amount, err := res.CPUHours.Float64()
 	if err != nil {
 		return err
 	}
-	log.Debug("done getting analysis id")
 
-	err = c.db.Begin(context)
+	details, err := json.Marshal(map[string]interface{}{
+		"step_number":       res.Step.StepNumber,
+		"period_start":      res.BasisTime,
+		"period_end":        res.CalcTime,
+		"end_date_fallback": res.EndDateFallback,
+		"period_split":      res.PeriodSplit,
+	})
 	if err != nil {
 		return err
 	}
-	defer c.db.Rollback() // nolint:errcheck
 
-	err = c.CalculateForAnalysisByID(context, analysisID)
-	if err != nil {
-		rollbackErr := c.db.Rollback()
-		if rollbackErr != nil {
-			log.WithError(rollbackErr).Error("failed to rollback transaction")
+	return c.store.AddAuditEntry(context, &db.AuditEntry{
+		UserID:       res.Analysis.UserID,
+		Username:     res.Username,
+		AnalysisID:   null.StringFrom(res.Analysis.ID),
+		ExternalID:   null.StringFrom(res.Step.ExternalID),
+		ResourceType: clients.ResourceTypeCPUHours,
+		Source:       c.auditSource,
+		Operation:    "ADD",
+		Amount:       amount,
+		Actor:        AuditActor,
+		Details:      details,
+	})
+}
+
+// withStore returns a copy of c that uses the given store, which is used to
+// run a calculation in a transaction.
+func (c *CPUHours) withStore(store Store) *CPUHours {
+	scoped := *c
+	scoped.store = store
+	return &scoped
+}
+
+// maxPeriodCharges is the most subscription periods that a single
+// calculation charges. Only the current subscription period's start and end
+// dates are known, so a calculation never needs more than three.
+const maxPeriodCharges = 10
+
+// calculateInTransaction calculates and records the usage for a step of an
+// analysis. The usage in each subscription period is recorded in its own
+// transaction, and the hooks are run after each transaction is committed. The
+// result for the last period is returned.
+func (c *CPUHours) calculateInTransaction(context context.Context, externalID string, allowFallback bool) (CalculationResult, error) {
+	var res CalculationResult
+
+	for i := 0; i < maxPeriodCharges; i++ {
+		res = CalculationResult{}
+
+		err := c.store.WithTx(context, func(tx Store) error {
+			var err error
+			res, err = c.withStore(tx).CalculateForStep(context, externalID, allowFallback)
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+
+		if !res.CPUHours.IsZero() {
+			c.runHooks(context, res.Username, &res)
+		}
+
+		if !res.remaining {
+			return res, nil
+		}
+	}
+
+	return res, fmt.Errorf("the usage for analysis step %s still spans a subscription period boundary after %d charges", externalID, maxPeriodCharges)
+}
+
+// errPreviewRollback is returned from the transaction used for a preview so
+// that the transaction is rolled back.
+var errPreviewRollback = errors.New("rolling back the usage preview")
+
+// Preview calculates the usage for a step of an analysis without recording it
+// or sending it to QMS.
+func (c *CPUHours) Preview(context context.Context, externalID string) (CalculationResult, error) {
+	var res CalculationResult
+
+	err := c.store.WithTx(context, func(tx Store) error {
+		var err error
+		if res, err = c.withStore(tx).CPUHoursForStep(context, externalID, false); err != nil {
+			return err
 		}
+		return errPreviewRollback
+	})
+	if errors.Is(err, errPreviewRollback) {
+		err = nil
+	}
+
+	return res, err
+}
+
+// RecordState records the time an analysis reached a state that matters for
+// accounting. States that don't matter for accounting are ignored.
+func (c *CPUHours) RecordState(context context.Context, externalID string, state messaging.JobState, at time.Time) error {
+	analysisID, err := c.store.GetAnalysisIDByExternalID(context, externalID)
+	if err != nil {
 		return err
-	} else {
-		return c.db.Commit()
 	}
+
+	switch state {
+	case messaging.SubmittedState:
+		return c.store.RecordSubmitted(context, analysisID, at)
+	case messaging.RunningState:
+		return c.store.RecordStarted(context, analysisID, at)
+	case messaging.FailedState, messaging.SucceededState, amqp.CanceledState:
+		return c.store.RecordFinished(context, analysisID, string(state), at)
+	}
+
+	return nil
+}
+
+// CalculateForAnalysis calculates the usage for the analysis step with the
+// given external ID. Usage for steps that don't have an end date yet is
+// deferred until they do.
+func (c *CPUHours) CalculateForAnalysis(context context.Context, externalID string) error {
+	res, err := c.calculateInTransaction(context, externalID, false)
+	if errors.Is(err, ErrEndDateMissing) {
+		log.WithContext(context).Infof("analysis step %s has no end date yet, deferring the usage calculation", externalID)
+		return c.store.DeferFinalization(context, res.Step.JobID, externalID)
+	}
+
+	return err
+}
+
+// UsageEvent returns the event describing the usage in the calculation result.
+func (r *CalculationResult) UsageEvent(username string) (*amqp.UsageEvent, error) {
+	amount, err := r.CPUHours.Float64()
+	if err != nil {
+		return nil, err
+	}
+
+	event := &amqp.UsageEvent{
+		Version:      amqp.UsageEventVersion,
+		AnalysisID:   r.Analysis.ID,
+		UserID:       r.Analysis.UserID,
+		Username:     clients.StripUsernameSuffix(username),
+		ResourceType: clients.ResourceTypeCPUHours,
+		Unit:         "cpu hours",
+		Operation:    "ADD",
+		Amount:       amount,
+		PeriodStart:  r.BasisTime,
+		PeriodEnd:    r.CalcTime,
+		RecordedAt:   time.Now().UTC(),
+	}
+
+	if r.Step != nil {
+		event.ExternalID = r.Step.ExternalID
+		event.StepNumber = r.Step.StepNumber
+	}
+
+	return event, nil
 }
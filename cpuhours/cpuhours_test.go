@@ -0,0 +1,494 @@
+package cpuhours_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/p/go/ptypes"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/fakes"
+	"github.com/guregu/null"
+)
+
+const (
+	userID     = "user-1"
+	username   = "ipcdev@iplantcollaborative.org"
+	analysisID = "analysis-1"
+	externalID = "external-1"
+)
+
+var (
+	started  = time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC)
+	finished = started.Add(2 * time.Hour)
+)
+
+// setup returns a store containing a user with an analysis that has a single step reserving two cores, which ran
+// for two hours if it has ended.
+func setup(ended bool) (*fakes.Store, *fakes.QMS, *cpuhours.CPUHours) {
+	store := fakes.NewStore()
+	store.AddUser(userID, username)
+	store.AddAnalysis(&db.Analysis{ID: analysisID, UserID: userID, StartDate: null.TimeFrom(started)})
+
+	step := &db.AnalysisStep{
+		JobID:              analysisID,
+		StepNumber:         1,
+		ExternalID:         externalID,
+		StartDate:          null.TimeFrom(started),
+		MillicoresReserved: 2000,
+	}
+	if ended {
+		step.EndDate = null.TimeFrom(finished)
+	}
+	store.AddStep(step)
+
+	qmsClient := fakes.NewQMS()
+	return store, qmsClient, cpuhours.New(store, qmsClient)
+}
+
+func TestCalculateForAnalysis(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	var hookCalls int
+	c.AddHook(func(_ context.Context, hookUser string, res *cpuhours.CalculationResult) error {
+		hookCalls++
+		if hookUser != username {
+			t.Errorf("expected the hook to be called for %s, got %s", username, hookUser)
+		}
+		return nil
+	})
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 1 {
+		t.Fatalf("expected one update, got %d", len(updates))
+	}
+	if updates[0].Update.Value != 4 || updates[0].Update.GetOperation().GetName() != "ADD" {
+		t.Errorf("expected 4 CPU hours to be added, got %+v", updates[0].Update)
+	}
+	if updates[0].Username != "ipcdev" {
+		t.Errorf("unexpected username: %s", updates[0].Username)
+	}
+
+	if len(store.AuditLog) != 1 || store.AuditLog[0].Amount != 4 || store.AuditLog[0].Source != db.AuditSourceCalculation {
+		t.Errorf("expected one audit entry for 4 CPU hours, got %+v", store.AuditLog)
+	}
+	if !store.Steps[externalID].UsageLastUpdate.Time.Equal(finished) {
+		t.Errorf("expected the step's usage last update to be %s, got %v", finished, store.Steps[externalID].UsageLastUpdate)
+	}
+	if !store.Analyses[analysisID].UsageLastUpdate.Time.Equal(finished) {
+		t.Errorf("expected the analysis's usage last update to be %s", finished)
+	}
+	if hookCalls != 1 {
+		t.Errorf("expected the hook to be called once, got %d", hookCalls)
+	}
+
+	// Handling the same update again doesn't charge for the same time twice.
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if updates = qmsClient.Updates(); len(updates) != 1 {
+		t.Errorf("expected nothing more to be sent to QMS, got %+v", updates)
+	}
+	if len(store.AuditLog) != 1 {
+		t.Errorf("expected a single audit entry, got %d", len(store.AuditLog))
+	}
+	if hookCalls != 1 {
+		t.Errorf("expected the hook not to be called again, got %d calls", hookCalls)
+	}
+}
+
+func TestCalculateForAnalysisUsesReportedStart(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	// The analysis reported that it started running an hour after the step started.
+	err := c.RecordState(context.Background(), externalID, messaging.RunningState, started.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !store.Accounting[analysisID].StartedAt.Valid {
+		t.Fatal("expected the start time to be recorded")
+	}
+
+	if err = c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if updates := qmsClient.Updates(); len(updates) != 1 || updates[0].Update.Value != 2 {
+		t.Errorf("expected 2 CPU hours to be charged, got %+v", updates)
+	}
+}
+
+func TestCalculateForAnalysisDefersWithoutEndDate(t *testing.T) {
+	store, qmsClient, c := setup(false)
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(qmsClient.Updates()) != 0 {
+		t.Error("didn't expect any updates to be sent")
+	}
+	finalization, ok := store.Finalizations[externalID]
+	if !ok || finalization.Status != "pending" || finalization.AnalysisID != analysisID {
+		t.Errorf("expected a pending finalization, got %+v", finalization)
+	}
+	if store.Steps[externalID].UsageLastUpdate.Valid {
+		t.Error("didn't expect the usage last update to be set")
+	}
+}
+
+func TestCalculateForAnalysisRollsBackWhenQMSFails(t *testing.T) {
+	store, qmsClient, c := setup(true)
+	qmsClient.Err = errors.New("QMS is down")
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if store.Steps[externalID].UsageLastUpdate.Valid || store.Analyses[analysisID].UsageLastUpdate.Valid {
+		t.Error("expected the usage last update times to be rolled back")
+	}
+	if len(store.AuditLog) != 0 {
+		t.Error("didn't expect an audit entry")
+	}
+}
+
+func TestCalculateForAnalysisSplitsAtSubscriptionStart(t *testing.T) {
+	_, qmsClient, c := setup(true)
+
+	// The subscription period started halfway through the analysis.
+	rollover := started.Add(time.Hour)
+	qmsClient.Subscriptions["ipcdev"] = &qms.Subscription{
+		Uuid:               "subscription-1",
+		EffectiveStartDate: ptypes.New(rollover),
+		EffectiveEndDate:   ptypes.New(rollover.AddDate(1, 0, 0)),
+	}
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("expected two updates, got %d", len(updates))
+	}
+	for i, effective := range []time.Time{started, rollover} {
+		if updates[i].Update.Value != 2 {
+			t.Errorf("update %d: expected 2 CPU hours, got %f", i, updates[i].Update.Value)
+		}
+		if !updates[i].Update.EffectiveDate.AsTime().Equal(effective) {
+			t.Errorf("update %d: expected it to be effective at %s, got %s", i, effective, updates[i].Update.EffectiveDate.AsTime())
+		}
+	}
+
+	// The fake applies usage updates to the subscription.
+	if usage := qmsClient.Subscriptions["ipcdev"].Usages; len(usage) != 1 || usage[0].Usage != 4 {
+		t.Errorf("expected 4 CPU hours of usage, got %+v", usage)
+	}
+}
+
+func TestCalculateForAnalysisSplitsAtSubMicrosecondBoundary(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	// The database only stores microseconds, so the step can't be recorded as charged up to this boundary exactly.
+	rollover := started.Add(time.Hour + 400*time.Nanosecond)
+	qmsClient.Subscriptions["ipcdev"] = &qms.Subscription{
+		Uuid:               "subscription-1",
+		EffectiveStartDate: ptypes.New(rollover),
+		EffectiveEndDate:   ptypes.New(rollover.AddDate(1, 0, 0)),
+	}
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("expected two updates, got %d", len(updates))
+	}
+	if usage := qmsClient.Subscriptions["ipcdev"].Usages; len(usage) != 1 || usage[0].Usage != 4 {
+		t.Errorf("expected 4 CPU hours of usage, got %+v", usage)
+	}
+	if !store.Steps[externalID].UsageLastUpdate.Time.Equal(finished) {
+		t.Errorf("expected the step to be charged up to %s, got %v", finished, store.Steps[externalID].UsageLastUpdate)
+	}
+}
+
+func TestCalculateForAnalysisResumesSplitCharges(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	rollover := started.Add(time.Hour)
+	qmsClient.Subscriptions["ipcdev"] = &qms.Subscription{
+		Uuid:               "subscription-1",
+		EffectiveStartDate: ptypes.New(rollover),
+		EffectiveEndDate:   ptypes.New(rollover.AddDate(1, 0, 0)),
+	}
+
+	// QMS accepts the usage from before the rollover, then fails.
+	qmsClient.Reject = func(_ string, update *qms.Update) error {
+		if update.EffectiveDate.AsTime().Equal(rollover) {
+			return errors.New("QMS is down")
+		}
+		return nil
+	}
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !store.Steps[externalID].UsageLastUpdate.Time.Equal(rollover) {
+		t.Errorf("expected the step to be charged up to %s, got %v", rollover, store.Steps[externalID].UsageLastUpdate)
+	}
+
+	// Retrying only charges the usage after the rollover.
+	qmsClient.Reject = nil
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("expected two updates, got %d", len(updates))
+	}
+	for i, start := range []time.Time{started, rollover} {
+		if updates[i].Update.Value != 2 {
+			t.Errorf("update %d: expected 2 CPU hours, got %f", i, updates[i].Update.Value)
+		}
+
+		// The metadata only describes the period that the update charges.
+		var metadata cpuhours.CalculationResult
+		if err := json.Unmarshal([]byte(updates[i].Update.Metadata), &metadata); err != nil {
+			t.Fatalf("update %d: unable to parse the metadata: %s", i, err)
+		}
+		if !metadata.BasisTime.Equal(start) || !metadata.CalcTime.Equal(start.Add(time.Hour)) || !metadata.PeriodSplit {
+			t.Errorf("update %d: unexpected metadata: %s", i, updates[i].Update.Metadata)
+		}
+		if hours, _ := metadata.CPUHours.Float64(); hours != 2 {
+			t.Errorf("update %d: expected 2 CPU hours in the metadata, got %s", i, metadata.CPUHours)
+		}
+	}
+
+	if len(store.AuditLog) != 2 || store.AuditLog[0].Amount != 2 || store.AuditLog[1].Amount != 2 {
+		t.Errorf("expected an audit entry for each period, got %+v", store.AuditLog)
+	}
+}
+
+func TestPreviewDoesNotRecordUsage(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	res, err := c.Preview(context.Background(), externalID)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if hours, _ := res.CPUHours.Float64(); hours != 4 {
+		t.Errorf("expected a preview of 4 CPU hours, got %s", res.CPUHours)
+	}
+
+	if len(qmsClient.Updates()) != 0 {
+		t.Error("didn't expect any updates to be sent")
+	}
+	if store.Steps[externalID].UsageLastUpdate.Valid {
+		t.Error("expected the preview to be rolled back")
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	adjustment, err := c.Adjust(context.Background(), &cpuhours.AdjustmentRequest{
+		Username:  username,
+		Operation: "subtract",
+		Amount:    1.5,
+		Reason:    "refund for a failed analysis",
+		Actor:     "admin",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if adjustment.ID == "" || adjustment.EventType != db.CPUHoursSubtract || adjustment.Status != db.AdjustmentApplied {
+		t.Errorf("unexpected adjustment: %+v", adjustment)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 1 || updates[0].Update.Value != -1.5 {
+		t.Errorf("expected 1.5 CPU hours to be subtracted, got %+v", updates)
+	}
+
+	// The adjustment was recorded before it was sent, so the update identifies it.
+	var metadata db.UsageAdjustment
+	if err = json.Unmarshal([]byte(updates[0].Update.Metadata), &metadata); err != nil || metadata.ID != adjustment.ID {
+		t.Errorf("expected the update's metadata to identify the adjustment, got %s", updates[0].Update.Metadata)
+	}
+
+	if len(store.Adjustments) != 1 || store.Adjustments[0].Status != db.AdjustmentApplied {
+		t.Errorf("expected the adjustment to be recorded as applied, got %+v", store.Adjustments)
+	}
+	if len(store.AuditLog) != 1 || store.AuditLog[0].Source != db.AuditSourceAdjustment {
+		t.Errorf("expected the adjustment to be audited")
+	}
+}
+
+func TestAdjustValidation(t *testing.T) {
+	store, qmsClient, c := setup(true)
+
+	requests := []*cpuhours.AdjustmentRequest{
+		{Username: username, Operation: "MULTIPLY", Amount: 2, Reason: "reason", Actor: "admin"},
+		{Username: username, Operation: "ADD", Amount: 2, Reason: " ", Actor: "admin"},
+		{Username: username, Operation: "ADD", Amount: -2, Reason: "reason", Actor: "admin"},
+		{Username: username, Operation: "RESET", Amount: 2, Reason: "reason", Actor: "admin"},
+		{Username: username, Operation: "ADD", Amount: 2, Reason: "reason"},
+	}
+
+	for _, req := range requests {
+		if _, err := c.Adjust(context.Background(), req); !errors.Is(err, cpuhours.ErrInvalidAdjustment) {
+			t.Errorf("expected %+v to be invalid, got %v", req, err)
+		}
+	}
+
+	if len(qmsClient.Updates()) != 0 || len(store.Adjustments) != 0 {
+		t.Error("didn't expect invalid adjustments to be recorded")
+	}
+}
+
+func TestAdjustRecordsQMSFailures(t *testing.T) {
+	store, qmsClient, c := setup(true)
+	qmsClient.Err = errors.New("QMS is down")
+
+	_, err := c.Adjust(context.Background(), &cpuhours.AdjustmentRequest{
+		Username:  username,
+		Operation: "ADD",
+		Amount:    10,
+		Reason:    "extra hours for a workshop",
+		Actor:     "admin",
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(store.Adjustments) != 1 || store.Adjustments[0].Status != db.AdjustmentFailed {
+		t.Fatalf("expected the adjustment to be recorded as failed, got %+v", store.Adjustments)
+	}
+	if reason := store.AdjustmentErrors[store.Adjustments[0].ID]; !strings.Contains(reason, "QMS is down") {
+		t.Errorf("expected the QMS error to be recorded, got %q", reason)
+	}
+	if len(store.AuditLog) != 0 {
+		t.Error("didn't expect a failed adjustment to be audited")
+	}
+}
+
+func TestFinalizerFallsBackAfterMaxAttempts(t *testing.T) {
+	store, qmsClient, c := setup(false)
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.RecordState(context.Background(), externalID, messaging.FailedState, finished); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Without a retry delay, every pending finalization is due on each pass.
+	finalizer := cpuhours.NewFinalizer(c, time.Minute, 0, 2, 10)
+	for i := 0; i < 2; i++ {
+		if err := finalizer.ProcessPending(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	finalization := store.Finalizations[externalID]
+	if finalization == nil || finalization.Status != "fallback" || !finalization.FallbackEnd.Time.Equal(finished) {
+		t.Errorf("expected the reported finish time to be used as a fallback, got %+v", finalization)
+	}
+	if updates := qmsClient.Updates(); len(updates) != 1 || updates[0].Update.Value != 4 {
+		t.Errorf("expected 4 CPU hours to be charged, got %+v", updates)
+	}
+	if len(store.AuditLog) != 1 || store.AuditLog[0].Source != db.AuditSourceCalculation {
+		t.Errorf("expected the usage to be audited as a calculation, got %+v", store.AuditLog)
+	}
+	if !strings.Contains(string(store.AuditLog[0].Details), `"end_date_fallback":true`) {
+		t.Errorf("expected the fallback to be recorded in the details, got %s", store.AuditLog[0].Details)
+	}
+}
+
+func TestFinalizerGivesUpAfterMaxAttempts(t *testing.T) {
+	store, qmsClient, c := setup(false)
+
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The step disappears, so its usage can't be calculated even with a substitute end date.
+	delete(store.Steps, externalID)
+
+	finalizer := cpuhours.NewFinalizer(c, time.Minute, 0, 2, 10)
+	for i := 0; i < 3; i++ {
+		if err := finalizer.ProcessPending(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	finalization := store.Finalizations[externalID]
+	if finalization == nil || finalization.Status != "failed" || !finalization.Error.Valid {
+		t.Fatalf("expected the finalization to fail with a reason, got %+v", finalization)
+	}
+	if finalization.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", finalization.Attempts)
+	}
+	if len(qmsClient.Updates()) != 0 {
+		t.Error("didn't expect any updates to be sent")
+	}
+}
+
+func TestCalculateForAnalysisStepsFinishingOutOfOrder(t *testing.T) {
+	store, qmsClient, c := setup(false)
+
+	// The second step runs alongside the first one, reserves one core, and finishes first.
+	const secondExternalID = "external-2"
+	store.AddStep(&db.AnalysisStep{
+		JobID:              analysisID,
+		StepNumber:         2,
+		ExternalID:         secondExternalID,
+		StartDate:          null.TimeFrom(started),
+		EndDate:            null.TimeFrom(started.Add(time.Hour)),
+		MillicoresReserved: 1000,
+	})
+
+	// The first step doesn't have an end date yet, so it's deferred.
+	if err := c.CalculateForAnalysis(context.Background(), externalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.CalculateForAnalysis(context.Background(), secondExternalID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The first step finishes after the second one.
+	store.Steps[externalID].EndDate = null.TimeFrom(finished)
+
+	finalizer := cpuhours.NewFinalizer(c, time.Minute, 0, 10, 10)
+	if err := finalizer.ProcessPending(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	updates := qmsClient.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("expected two updates, got %d", len(updates))
+	}
+	for i, expected := range []float64{1, 4} {
+		if updates[i].Update.Value != expected {
+			t.Errorf("update %d: expected %g CPU hours, got %g", i, expected, updates[i].Update.Value)
+		}
+	}
+
+	if _, ok := store.Finalizations[externalID]; ok {
+		t.Error("expected the finalization to be completed")
+	}
+	if !store.Analyses[analysisID].UsageLastUpdate.Time.Equal(finished) {
+		t.Errorf("expected the analysis's usage last update to be %s, got %v", finished, store.Analyses[analysisID].UsageLastUpdate)
+	}
+}
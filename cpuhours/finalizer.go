@@ -0,0 +1,100 @@
+package cpuhours
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Finalizer periodically re-examines analysis steps whose usage couldn't be
+// calculated because they didn't have an end date yet.
+type Finalizer struct {
+	cpuhours    *CPUHours
+	interval    time.Duration
+	retryDelay  time.Duration
+	maxAttempts int
+	batchSize   int
+}
+
+// NewFinalizer returns a new *Finalizer. Pending analyses are checked every
+// interval, with the delay between attempts for an analysis growing by
+// retryDelay each time. After maxAttempts, the usage is finalized using a
+// substitute end date, or marked as failed if it can't be calculated for some
+// other reason.
+func NewFinalizer(cpuhours *CPUHours, interval, retryDelay time.Duration, maxAttempts, batchSize int) *Finalizer {
+	return &Finalizer{
+		cpuhours:    cpuhours,
+		interval:    interval,
+		retryDelay:  retryDelay,
+		maxAttempts: maxAttempts,
+		batchSize:   batchSize,
+	}
+}
+
+// Run processes pending finalizations until the context is cancelled.
+func (f *Finalizer) Run(context context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+			if err := f.ProcessPending(context); err != nil {
+				log.WithContext(context).WithError(err).Error("unable to process pending finalizations")
+			}
+		}
+	}
+}
+
+// ProcessPending attempts to finalize the usage of the pending analyses that
+// are due to be retried.
+func (f *Finalizer) ProcessPending(context context.Context) error {
+	finalizations, err := f.cpuhours.store.ClaimFinalizations(context, f.batchSize, f.retryDelay)
+	if err != nil {
+		return err
+	}
+
+	for _, finalization := range finalizations {
+		msgLog := log.WithFields(logrus.Fields{
+			"context":    "finalizing usage",
+			"analysisID": finalization.AnalysisID,
+			"externalID": finalization.ExternalID,
+			"attempt":    finalization.Attempts,
+		}).WithContext(context)
+
+		allowFallback := finalization.Attempts >= f.maxAttempts
+		res, err := f.cpuhours.calculateInTransaction(context, finalization.ExternalID, allowFallback)
+		if errors.Is(err, ErrEndDateMissing) {
+			msgLog.Debugf("still waiting for the end date, next attempt at %s", finalization.NextAttemptAt)
+			continue
+		}
+		if err != nil {
+			if !allowFallback {
+				msgLog.WithError(err).Error("unable to finalize usage, will try again")
+				continue
+			}
+			msgLog.WithError(err).Error("unable to finalize usage, giving up")
+			if err = f.cpuhours.store.FailFinalization(context, finalization.ExternalID, err.Error()); err != nil {
+				msgLog.WithError(err).Error("unable to update the finalization record")
+			}
+			continue
+		}
+
+		if res.EndDateFallback {
+			msgLog.Warnf("finalized usage without an end date, using %s instead", res.CalcTime)
+			err = f.cpuhours.store.RecordFinalizationFallback(context, finalization.ExternalID, res.CalcTime)
+		} else {
+			msgLog.Info("finalized usage")
+			err = f.cpuhours.store.CompleteFinalization(context, finalization.ExternalID)
+		}
+		if err != nil {
+			msgLog.WithError(err).Error("unable to update the finalization record")
+		}
+	}
+
+	return nil
+}
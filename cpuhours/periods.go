@@ -0,0 +1,83 @@
+package cpuhours
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/clients"
+)
+
+// PeriodCharge is the part of a calculation result that's charged to a single subscription period.
+type PeriodCharge struct {
+	Start    time.Time    `json:"start"`
+	End      time.Time    `json:"end"`
+	CPUHours *apd.Decimal `json:"cpu_hours"`
+}
+
+// SplitByPeriod splits the CPU hours used between the start and end times at the subscription period boundaries
+// that fall between them. The CPU hours are divided in proportion to the time spent in each period, and the last
+// period gets whatever is left after rounding so that the charges always add up to the total.
+func SplitByPeriod(total *apd.Decimal, start, end time.Time, boundaries ...time.Time) ([]PeriodCharge, error) {
+	var cuts []time.Time
+	for _, boundary := range boundaries {
+		if boundary.After(start) && boundary.Before(end) {
+			cuts = append(cuts, boundary)
+		}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].Before(cuts[j]) })
+
+	charges := make([]PeriodCharge, 0, len(cuts)+1)
+	remaining := apd.New(0, 0).Set(total)
+	duration := apd.New(end.Sub(start).Nanoseconds(), 0)
+	bc := apd.BaseContext.WithPrecision(precision)
+
+	periodStart := start
+	for _, cut := range cuts {
+		if cut.Equal(periodStart) {
+			continue
+		}
+
+		cpuHours := apd.New(0, 0)
+		if _, err := bc.Mul(cpuHours, total, apd.New(cut.Sub(periodStart).Nanoseconds(), 0)); err != nil {
+			return nil, err
+		}
+		if _, err := bc.Quo(cpuHours, cpuHours, duration); err != nil {
+			return nil, err
+		}
+		if _, err := bc.Sub(remaining, remaining, cpuHours); err != nil {
+			return nil, err
+		}
+
+		charges = append(charges, PeriodCharge{Start: periodStart, End: cut, CPUHours: cpuHours})
+		periodStart = cut
+	}
+
+	return append(charges, PeriodCharge{Start: periodStart, End: end, CPUHours: remaining}), nil
+}
+
+// subscriptionBoundaries returns the start and end dates of the user's current subscription period. Nothing is
+// returned if the user doesn't have a subscription.
+func (c *CPUHours) subscriptionBoundaries(context context.Context, username string) ([]time.Time, error) {
+	subscription, err := c.subscriptions.GetUserSubscription(context, username)
+	if clients.GetStatusCode(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The boundaries are truncated to the precision of the timestamps in the database. Otherwise, a step charged up
+	// to a boundary with a fraction of a microsecond would be stored as charged up to just before it, and the next
+	// calculation would split at the same boundary again.
+	var boundaries []time.Time
+	if start := subscription.GetEffectiveStartDate(); start != nil && !start.IsZero() {
+		boundaries = append(boundaries, start.AsTime().Truncate(time.Microsecond))
+	}
+	if end := subscription.GetEffectiveEndDate(); end != nil && !end.IsZero() {
+		boundaries = append(boundaries, end.AsTime().Truncate(time.Microsecond))
+	}
+	return boundaries, nil
+}
@@ -0,0 +1,66 @@
+package cpuhours
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+func TestSplitByPeriod(t *testing.T) {
+	start := time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 4, 1, 4, 0, 0, 0, time.UTC)
+	rollover := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		total      string
+		boundaries []time.Time
+		expected   []string
+	}{
+		{"no boundaries", "6", nil, []string{"6"}},
+		{"boundary outside the usage", "6", []time.Time{start.Add(-time.Hour), end.Add(time.Hour)}, []string{"6"}},
+		{"boundary at the start", "6", []time.Time{start}, []string{"6"}},
+		{"one rollover", "6", []time.Time{rollover}, []string{"2", "4"}},
+		{"two rollovers", "6", []time.Time{rollover.Add(2 * time.Hour), rollover}, []string{"2", "2", "2"}},
+		{"uneven split", "1", []time.Time{rollover}, []string{"0.333333333333333", "0.666666666666667"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			total, _, err := apd.NewFromString(test.total)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			charges, err := SplitByPeriod(total, start, end, test.boundaries...)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(charges) != len(test.expected) {
+				t.Fatalf("expected %d charges, got %d", len(test.expected), len(charges))
+			}
+
+			sum := apd.New(0, 0)
+			for i, charge := range charges {
+				expected, _, _ := apd.NewFromString(test.expected[i])
+				if charge.CPUHours.Cmp(expected) != 0 {
+					t.Errorf("charge %d: expected %s, got %s", i, expected, charge.CPUHours)
+				}
+				if i > 0 && !charge.Start.Equal(charges[i-1].End) {
+					t.Errorf("charge %d doesn't start where the previous one ended", i)
+				}
+				if _, err = apd.BaseContext.Add(sum, sum, charge.CPUHours); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !charges[0].Start.Equal(start) || !charges[len(charges)-1].End.Equal(end) {
+				t.Errorf("charges don't cover the usage: %+v", charges)
+			}
+			if sum.Cmp(total) != 0 {
+				t.Errorf("charges add up to %s instead of %s", sum, total)
+			}
+		})
+	}
+}
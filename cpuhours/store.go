@@ -0,0 +1,68 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// AnalysisLookup finds the analyses, analysis steps, and users that usage is calculated for.
+type AnalysisLookup interface {
+	StepByExternalID(context context.Context, externalID string) (*db.AnalysisStep, error)
+	AnalysisWithoutUser(context context.Context, analysisID string) (*db.Analysis, error)
+	GetAnalysisIDByExternalID(context context.Context, externalID string) (string, error)
+	Username(context context.Context, userID string) (string, error)
+	UserByUsername(context context.Context, username string) (*db.User, error)
+}
+
+// UsagePersistence records the usage that was calculated along with the state needed to calculate it.
+type UsagePersistence interface {
+	RecordSubmitted(context context.Context, analysisID string, at time.Time) error
+	RecordStarted(context context.Context, analysisID string, at time.Time) error
+	RecordFinished(context context.Context, analysisID, state string, at time.Time) error
+	SetStepUsageLastUpdate(context context.Context, externalID string, usagetime time.Time) error
+	SetUsageLastUpdate(context context.Context, analysisID string, usagetime time.Time) error
+	AddAuditEntry(context context.Context, entry *db.AuditEntry) error
+	AddUsageAdjustment(context context.Context, adjustment *db.UsageAdjustment) error
+	CompleteUsageAdjustment(context context.Context, id string) error
+	FailUsageAdjustment(context context.Context, id, reason string) error
+	DeferFinalization(context context.Context, analysisID, externalID string) error
+	ClaimFinalizations(context context.Context, limit int, retryDelay time.Duration) ([]db.Finalization, error)
+	CompleteFinalization(context context.Context, externalID string) error
+	RecordFinalizationFallback(context context.Context, externalID string, fallbackEnd time.Time) error
+	FailFinalization(context context.Context, externalID, reason string) error
+}
+
+// Store is the storage used to calculate and record usage.
+type Store interface {
+	AnalysisLookup
+	UsagePersistence
+
+	// WithTx runs fn with a Store whose changes are kept if fn returns nil and discarded otherwise. If the Store is
+	// already scoped to a transaction, fn runs in that transaction.
+	WithTx(context context.Context, fn func(tx Store) error) error
+}
+
+// QMSClient sends usage updates to QMS and looks up users' subscriptions. *clients.Subscriptions implements it.
+type QMSClient interface {
+	AddUserUpdate(context context.Context, username string, update *qms.Update) error
+	GetUserSubscription(context context.Context, username string) (*qms.Subscription, error)
+}
+
+// databaseStore is the Store backed by the DE database.
+type databaseStore struct {
+	*db.Database
+}
+
+// DatabaseStore returns a Store backed by the DE database.
+func DatabaseStore(database *db.Database) Store {
+	return databaseStore{database}
+}
+
+func (s databaseStore) WithTx(context context.Context, fn func(tx Store) error) error {
+	return s.Database.WithTx(context, func(tx *db.Database) error {
+		return fn(databaseStore{tx})
+	})
+}
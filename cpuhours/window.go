@@ -0,0 +1,65 @@
+package cpuhours
+
+import (
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+)
+
+// usageWindow returns the times that the usage for a step of an analysis is calculated from and to, and whether a
+// substitute was used for the end date. The times from the database are instants, so the window is the same no
+// matter which time zone they're in and includes any daylight saving time changes.
+func usageWindow(step *db.AnalysisStep, analysis *db.Analysis, allowFallback bool, now time.Time) (time.Time, time.Time, bool, error) {
+	var (
+		basisTime time.Time
+		calcTime  time.Time
+		fallback  bool
+	)
+
+	// It's possible for this to be reached before the database is updated
+	// with the actual end date. Rather than waiting for it here, the caller
+	// defers the step so that it's re-examined later. Once the caller gives
+	// up waiting, the time the analysis reported that it finished is used,
+	// followed by the current time. Either way, the result is flagged so that
+	// it can be corrected later.
+	switch {
+	case step.EndDate.Valid:
+		calcTime = step.EndDate.Time.UTC()
+	case !allowFallback:
+		return basisTime, calcTime, false, ErrEndDateMissing
+	case analysis.AccountingEnd.Valid:
+		calcTime = analysis.AccountingEnd.Time.UTC()
+		fallback = true
+	default:
+		calcTime = now.UTC()
+		fallback = true
+	}
+
+	// Start calculation at the most recent of the start times or the step's
+	// usage last update time, then calculate to the end date (or its
+	// substitute). The time the analysis reported that it was running counts
+	// as a start time because that's when it actually started consuming
+	// resources. The step start date takes over for later steps, which start
+	// after the analysis started running. The step's usage last update time
+	// guards against charging again for time that was already accounted for.
+	// The analysis's usage last update time isn't used because it's moved by
+	// every step, and steps can run in parallel or finish out of order.
+	for _, t := range []null.Time{
+		step.StartDate,
+		analysis.AccountingStart,
+		step.UsageLastUpdate,
+	} {
+		if t.Valid && t.Time.UTC().After(basisTime) {
+			basisTime = t.Time.UTC()
+		}
+	}
+	if basisTime.IsZero() {
+		basisTime = analysis.StartDate.Time.UTC()
+	}
+	if calcTime.Before(basisTime) {
+		calcTime = basisTime
+	}
+
+	return basisTime, calcTime, fallback, nil
+}
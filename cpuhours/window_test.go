@@ -0,0 +1,117 @@
+package cpuhours
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+)
+
+func TestUsageWindowAcrossDSTChanges(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data isn't available: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		expected time.Duration
+	}{
+		{
+			// Clocks jump from 2:00 to 3:00, so 1:30 to 3:30 is one hour.
+			name:     "spring forward",
+			start:    time.Date(2024, 3, 10, 1, 30, 0, 0, newYork),
+			end:      time.Date(2024, 3, 10, 3, 30, 0, 0, newYork),
+			expected: time.Hour,
+		},
+		{
+			// Clocks fall back from 2:00 to 1:00, so 0:30 to 2:30 is three hours.
+			name:     "fall back",
+			start:    time.Date(2024, 11, 3, 0, 30, 0, 0, newYork),
+			end:      time.Date(2024, 11, 3, 2, 30, 0, 0, newYork),
+			expected: 3 * time.Hour,
+		},
+		{
+			name:     "no change",
+			start:    time.Date(2024, 6, 1, 0, 30, 0, 0, newYork),
+			end:      time.Date(2024, 6, 1, 2, 30, 0, 0, newYork),
+			expected: 2 * time.Hour,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step := &db.AnalysisStep{StartDate: null.TimeFrom(test.start), EndDate: null.TimeFrom(test.end)}
+
+			basisTime, calcTime, fallback, err := usageWindow(step, &db.Analysis{}, false, time.Now())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fallback {
+				t.Error("didn't expect a fallback end date")
+			}
+			if basisTime.Location() != time.UTC || calcTime.Location() != time.UTC {
+				t.Errorf("expected UTC times, got %s and %s", basisTime, calcTime)
+			}
+			if calcTime.Sub(basisTime) != test.expected {
+				t.Errorf("expected a window of %s, got %s", test.expected, calcTime.Sub(basisTime))
+			}
+
+			cpuHours, err := Calculate(1000, calcTime.Sub(basisTime))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if hours, _ := cpuHours.Float64(); hours != test.expected.Hours() {
+				t.Errorf("expected %g CPU hours, got %s", test.expected.Hours(), cpuHours)
+			}
+		})
+	}
+}
+
+func TestUsageWindowUsesLatestStart(t *testing.T) {
+	phoenix := time.FixedZone("MST", -7*60*60)
+	stepStart := time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC)
+
+	// The last update is later than the step start even though its wall clock time is earlier.
+	lastUpdate := time.Date(2024, 3, 9, 19, 0, 0, 0, phoenix)
+	end := time.Date(2024, 3, 10, 4, 0, 0, 0, time.UTC)
+
+	step := &db.AnalysisStep{
+		StartDate:       null.TimeFrom(stepStart),
+		EndDate:         null.TimeFrom(end),
+		UsageLastUpdate: null.TimeFrom(lastUpdate),
+	}
+
+	basisTime, calcTime, _, err := usageWindow(step, &db.Analysis{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !basisTime.Equal(lastUpdate) {
+		t.Errorf("expected the window to start at the last update, got %s", basisTime)
+	}
+	if calcTime.Sub(basisTime) != 2*time.Hour {
+		t.Errorf("expected a window of 2h, got %s", calcTime.Sub(basisTime))
+	}
+}
+
+func TestUsageWindowFallback(t *testing.T) {
+	start := time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC)
+	now := start.Add(90 * time.Minute)
+	step := &db.AnalysisStep{StartDate: null.TimeFrom(start)}
+
+	if _, _, _, err := usageWindow(step, &db.Analysis{}, false, now); !errors.Is(err, ErrEndDateMissing) {
+		t.Errorf("expected ErrEndDateMissing, got %v", err)
+	}
+
+	_, calcTime, fallback, err := usageWindow(step, &db.Analysis{}, true, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !fallback || !calcTime.Equal(now) {
+		t.Errorf("expected the current time to be used as a fallback, got %s (fallback %t)", calcTime, fallback)
+	}
+}
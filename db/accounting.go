@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// RecordSubmitted records when an analysis was submitted. Submitted analyses aren't consuming resources yet, so
+// this is only tracked for reference.
+func (d *Database) RecordSubmitted(context context.Context, analysisID string, at time.Time) error {
+	const q = `
+		INSERT INTO analysis_accounting (job_id, submitted_at)
+		VALUES ($1, $2)
+		ON CONFLICT (job_id) DO UPDATE
+		SET submitted_at = LEAST(analysis_accounting.submitted_at, EXCLUDED.submitted_at)
+	`
+	_, err := d.Q().ExecContext(context, q, analysisID, at.UTC())
+	return err
+}
+
+// RecordStarted records when an analysis started running, which is when it starts consuming resources. The
+// earliest time is kept if the analysis reports that it's running more than once.
+func (d *Database) RecordStarted(context context.Context, analysisID string, at time.Time) error {
+	const q = `
+		INSERT INTO analysis_accounting (job_id, started_at)
+		VALUES ($1, $2)
+		ON CONFLICT (job_id) DO UPDATE
+		SET started_at = LEAST(analysis_accounting.started_at, EXCLUDED.started_at)
+	`
+	_, err := d.Q().ExecContext(context, q, analysisID, at.UTC())
+	return err
+}
+
+// RecordFinished records when an analysis reached a final state along with the state itself.
+func (d *Database) RecordFinished(context context.Context, analysisID, state string, at time.Time) error {
+	const q = `
+		INSERT INTO analysis_accounting (job_id, finished_at, final_state)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (job_id) DO UPDATE
+		SET finished_at = EXCLUDED.finished_at,
+		    final_state = EXCLUDED.final_state
+	`
+	_, err := d.Q().ExecContext(context, q, analysisID, at.UTC(), state)
+	return err
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// AdjustmentStatus records whether QMS has accepted a usage adjustment.
+type AdjustmentStatus string
+
+// The statuses of usage adjustments.
+const (
+	// AdjustmentPending is the status of an adjustment that hasn't been accepted by QMS yet. Adjustments are left
+	// pending if QMS accepted them but the status couldn't be updated afterwards.
+	AdjustmentPending AdjustmentStatus = "pending"
+
+	// AdjustmentApplied is the status of an adjustment that QMS accepted.
+	AdjustmentApplied AdjustmentStatus = "applied"
+
+	// AdjustmentFailed is the status of an adjustment that QMS didn't accept.
+	AdjustmentFailed AdjustmentStatus = "failed"
+)
+
+// UsageAdjustment is a manual adjustment to a user's usage made by an administrator.
+type UsageAdjustment struct {
+	ID           string           `db:"id" json:"id"`
+	UserID       string           `db:"user_id" json:"user_id"`
+	Username     string           `db:"username" json:"username"`
+	ResourceType string           `db:"resource_type" json:"resource_type"`
+	EventType    EventType        `db:"event_type" json:"event_type"`
+	Amount       float64          `db:"amount" json:"amount"`
+	Reason       string           `db:"reason" json:"reason"`
+	Actor        string           `db:"actor" json:"actor"`
+	Status       AdjustmentStatus `db:"status" json:"status"`
+	CreatedAt    time.Time        `db:"created_at" json:"created_at"`
+}
+
+// UserByUsername returns the user with the given username, which must include the domain suffix.
+func (d *Database) UserByUsername(context context.Context, username string) (*User, error) {
+	var user User
+
+	const q = `
+		SELECT id, username
+		FROM users
+		WHERE username = $1;
+	`
+
+	if err := d.Q().QueryRowxContext(context, q, username).StructScan(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// AddUsageAdjustment records a pending adjustment. The ID, status, and creation time are filled in from the database.
+func (d *Database) AddUsageAdjustment(context context.Context, adjustment *UsageAdjustment) error {
+	const q = `
+		INSERT INTO usage_adjustments (user_id, resource_type, event_type, amount, reason, actor)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, created_at
+	`
+	return d.Q().QueryRowxContext(
+		context,
+		q,
+		adjustment.UserID,
+		adjustment.ResourceType,
+		adjustment.EventType,
+		adjustment.Amount,
+		adjustment.Reason,
+		adjustment.Actor,
+	).Scan(&adjustment.ID, &adjustment.Status, &adjustment.CreatedAt)
+}
+
+// CompleteUsageAdjustment marks an adjustment as accepted by QMS.
+func (d *Database) CompleteUsageAdjustment(context context.Context, id string) error {
+	const q = `
+		UPDATE usage_adjustments
+		SET status = 'applied'
+		WHERE id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, id)
+	return err
+}
+
+// FailUsageAdjustment marks an adjustment as rejected by QMS, recording the reason.
+func (d *Database) FailUsageAdjustment(context context.Context, id, reason string) error {
+	const q = `
+		UPDATE usage_adjustments
+		SET status = 'failed',
+		    error = $2
+		WHERE id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, id, reason)
+	return err
+}
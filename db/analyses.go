@@ -20,6 +20,8 @@ type Analysis struct {
 	SystemID        string      `db:"system_id"`
 	Subdomain       null.String `db:"subdomain"`
 	UsageLastUpdate null.Time   `db:"usage_last_update"`
+	AccountingStart null.Time   `db:"accounting_start"`
+	AccountingEnd   null.Time   `db:"accounting_end"`
 }
 
 // GetAnalysisIDByExternalID returns the analysis ID based on the external ID
@@ -44,39 +46,39 @@ func (d *Database) AnalysisWithoutUser(context context.Context, analysisID strin
 		SELECT
 			j.id,
 			j.app_id,
-			j.start_date,
-			j.end_date,
+			j.start_date::timestamptz start_date,
+			j.end_date::timestamptz end_date,
 			j.status,
 			j.deleted,
 			j.submission,
 			j.user_id,
 			j.subdomain,
-			j.usage_last_update,
+			j.usage_last_update::timestamptz usage_last_update,
+			a.started_at accounting_start,
+			a.finished_at accounting_end,
 			t.name job_type,
 			t.system_id
 		FROM jobs j
 		JOIN job_types t ON j.job_type_id = t.id
+		LEFT JOIN analysis_accounting a ON a.job_id = j.id
 		WHERE j.id = $1
-		FOR NO KEY UPDATE;
+		FOR NO KEY UPDATE OF j;
 	`
 	var analysis Analysis
 	err := d.Q().QueryRowxContext(context, q, analysisID).StructScan(&analysis)
 	return &analysis, err
 }
 
-// SetUsageLastUpdate updates the `usage_last_update` column of the jobs table to the provided time
+// SetUsageLastUpdate updates the `usage_last_update` column of the jobs table to the provided time. The steps of an
+// analysis are accounted for separately, so the column is only moved forward. It records the latest time that usage
+// was charged for any of the steps and isn't used to calculate usage. The column doesn't have a time zone, so
+// the database converts the time to the session time zone when it's stored.
 func (d *Database) SetUsageLastUpdate(context context.Context, analysisID string, usagetime time.Time) error {
 	const q = `
-		UPDATE jobs 
-		SET usage_last_update = $2
+		UPDATE jobs
+		SET usage_last_update = GREATEST(usage_last_update::timestamptz, $2::timestamptz)
 		WHERE id = $1
 	`
-
-	_, err := d.Q().ExecContext(
-		context,
-		q,
-		analysisID,
-		usagetime.Local(), // we store things in the DB as non-UTC time
-	)
+	_, err := d.Q().ExecContext(context, q, analysisID, usagetime)
 	return err
 }
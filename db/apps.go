@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// AppUsage contains statistics about the analyses of an app that started during a time window.
+type AppUsage struct {
+	AppID                string     `db:"-" json:"app_id"`
+	From                 time.Time  `db:"-" json:"from"`
+	To                   time.Time  `db:"-" json:"to"`
+	Runs                 int        `db:"runs" json:"runs"`
+	Completed            int        `db:"completed" json:"completed"`
+	Failed               int        `db:"failed" json:"failed"`
+	Canceled             int        `db:"canceled" json:"canceled"`
+	CPUHours             float64    `db:"cpu_hours" json:"cpu_hours"`
+	MedianRuntimeSeconds null.Float `db:"median_runtime_seconds" json:"median_runtime_seconds"`
+	P95RuntimeSeconds    null.Float `db:"p95_runtime_seconds" json:"p95_runtime_seconds"`
+	AvgMillicores        null.Float `db:"avg_millicores_reserved" json:"avg_millicores_reserved"`
+}
+
+// AppUsage returns statistics about the analyses of an app that started between the start and end times. Runtimes
+// only include analyses that have ended, and CPU hours only include analysis steps that have ended.
+func (d *Database) AppUsage(context context.Context, appID string, from, to time.Time) (*AppUsage, error) {
+	const q = `
+		WITH analyses AS (
+			SELECT
+				j.id,
+				j.status,
+				j.millicores_reserved,
+				EXTRACT(EPOCH FROM (j.end_date::timestamptz - j.start_date::timestamptz)) runtime_seconds,
+				(
+					SELECT sum(
+						COALESCE(s.millicores_reserved, j.millicores_reserved, 0)::numeric
+						* EXTRACT(EPOCH FROM (s.end_date::timestamptz - s.start_date::timestamptz)) / 3600 / 1000
+					)
+					FROM job_steps s
+					WHERE s.job_id = j.id
+					AND s.start_date IS NOT NULL
+					AND s.end_date IS NOT NULL
+				) cpu_hours
+			FROM jobs j
+			WHERE j.app_id = $1
+			AND j.start_date::timestamptz >= $2::timestamptz
+			AND j.start_date::timestamptz < $3::timestamptz
+			AND NOT j.deleted
+		)
+		SELECT
+			count(*) runs,
+			count(*) FILTER (WHERE status = 'Completed') completed,
+			count(*) FILTER (WHERE status = 'Failed') failed,
+			count(*) FILTER (WHERE status = 'Canceled') canceled,
+			COALESCE(sum(cpu_hours), 0)::double precision cpu_hours,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY runtime_seconds) median_runtime_seconds,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY runtime_seconds) p95_runtime_seconds,
+			avg(millicores_reserved)::double precision avg_millicores_reserved
+		FROM analyses;
+	`
+
+	usage := AppUsage{AppID: appID, From: from, To: to}
+	if err := d.Q().QueryRowxContext(context, q, appID, from, to).StructScan(&usage); err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
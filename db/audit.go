@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// AuditSource identifies what made a change to a user's usage.
+type AuditSource string
+
+const (
+	// AuditSourceCalculation is used for usage calculated from an analysis as it finishes.
+	AuditSourceCalculation AuditSource = "calculation"
+
+	// AuditSourceAdjustment is used for manual adjustments made by administrators.
+	AuditSourceAdjustment AuditSource = "adjustment"
+
+	// AuditSourceRecalculation is used for usage calculated when job updates are replayed.
+	AuditSourceRecalculation AuditSource = "recalculation"
+)
+
+// AuditEntry records a single change to a user's usage.
+type AuditEntry struct {
+	ID           int64          `db:"id" json:"id"`
+	UserID       string         `db:"user_id" json:"user_id"`
+	Username     string         `db:"username" json:"username"`
+	AnalysisID   null.String    `db:"analysis_id" json:"analysis_id"`
+	ExternalID   null.String    `db:"external_id" json:"external_id"`
+	ResourceType string         `db:"resource_type" json:"resource_type"`
+	Source       AuditSource    `db:"source" json:"source"`
+	Operation    string         `db:"operation" json:"operation"`
+	Amount       float64        `db:"amount" json:"amount"`
+	Actor        string         `db:"actor" json:"actor"`
+	Details      types.JSONText `db:"details" json:"details,omitempty"`
+	RecordedAt   time.Time      `db:"recorded_at" json:"recorded_at"`
+}
+
+// AuditFilter limits the audit entries returned by AuditEntries. Empty fields aren't used to filter the entries.
+type AuditFilter struct {
+	Username   string
+	AnalysisID string
+	Actor      string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// AddAuditEntry appends an entry to the audit log. The ID and recording time are filled in from the database.
+func (d *Database) AddAuditEntry(context context.Context, entry *AuditEntry) error {
+	const q = `
+		INSERT INTO usage_audit_log (
+			user_id, username, analysis_id, external_id, resource_type, source, operation, amount, actor, details
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, recorded_at
+	`
+
+	var details interface{}
+	if len(entry.Details) > 0 {
+		details = entry.Details
+	}
+
+	return d.Q().QueryRowxContext(
+		context,
+		q,
+		entry.UserID,
+		entry.Username,
+		entry.AnalysisID,
+		entry.ExternalID,
+		entry.ResourceType,
+		entry.Source,
+		entry.Operation,
+		entry.Amount,
+		entry.Actor,
+		details,
+	).Scan(&entry.ID, &entry.RecordedAt)
+}
+
+// auditQuery returns the query and arguments used to look up the audit entries matching the filter.
+func auditQuery(filter *AuditFilter) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Username != "" {
+		addCondition("username = $%d", filter.Username)
+	}
+	if filter.AnalysisID != "" {
+		addCondition("analysis_id = $%d", filter.AnalysisID)
+	}
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if !filter.From.IsZero() {
+		addCondition("recorded_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("recorded_at < $%d", filter.To)
+	}
+
+	q := `
+		SELECT id, user_id, username, analysis_id, external_id, resource_type, source, operation, amount, actor,
+			details, recorded_at
+		FROM usage_audit_log
+	`
+	if len(conditions) > 0 {
+		q += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	q += fmt.Sprintf(" ORDER BY recorded_at DESC, id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	return q, args
+}
+
+// AuditEntries returns the audit entries matching the filter, most recent first.
+func (d *Database) AuditEntries(context context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	q, args := auditQuery(filter)
+
+	rows, err := d.Q().QueryxContext(context, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err = rows.StructScan(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditQuery(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	tests := []struct {
+		name       string
+		filter     AuditFilter
+		conditions string
+		args       []interface{}
+	}{
+		{
+			name:   "no filters",
+			filter: AuditFilter{Limit: 100},
+			args:   []interface{}{100, 0},
+		},
+		{
+			name:       "username",
+			filter:     AuditFilter{Username: "ipcdev", Limit: 10, Offset: 20},
+			conditions: "WHERE username = $1 ORDER BY recorded_at DESC, id DESC LIMIT $2 OFFSET $3",
+			args:       []interface{}{"ipcdev", 10, 20},
+		},
+		{
+			name: "all filters",
+			filter: AuditFilter{
+				Username:   "ipcdev",
+				AnalysisID: "analysis-1",
+				Actor:      "admin",
+				From:       from,
+				To:         to,
+				Limit:      100,
+			},
+			conditions: "WHERE username = $1 AND analysis_id = $2 AND actor = $3 AND recorded_at >= $4 AND recorded_at < $5 " +
+				"ORDER BY recorded_at DESC, id DESC LIMIT $6 OFFSET $7",
+			args: []interface{}{"ipcdev", "analysis-1", "admin", from, to, 100, 0},
+		},
+		{
+			name:       "time range only",
+			filter:     AuditFilter{To: to, Limit: 100},
+			conditions: "WHERE recorded_at < $1 ORDER BY recorded_at DESC, id DESC LIMIT $2 OFFSET $3",
+			args:       []interface{}{to, 100, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, args := auditQuery(&test.filter)
+
+			if test.conditions == "" {
+				if strings.Contains(q, "WHERE") {
+					t.Errorf("didn't expect any conditions: %s", q)
+				}
+				if !strings.HasSuffix(q, "LIMIT $1 OFFSET $2") {
+					t.Errorf("unexpected query: %s", q)
+				}
+			} else if !strings.HasSuffix(q, test.conditions) {
+				t.Errorf("expected the query to end with %q, got %q", test.conditions, q)
+			}
+
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("expected arguments %v, got %v", test.args, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnectionSettings contains the settings for the database connection pool and for connecting to the database at
+// startup.
+type ConnectionSettings struct {
+	// The maximum number of open connections. Zero means unlimited.
+	MaxOpenConns int
+
+	// The maximum number of idle connections.
+	MaxIdleConns int
+
+	// The maximum amount of time a connection may be reused. Zero means connections are never closed because of their
+	// age.
+	ConnMaxLifetime time.Duration
+
+	// The maximum amount of time a connection may be idle. Zero means connections are never closed because they're
+	// idle.
+	ConnMaxIdleTime time.Duration
+
+	// The maximum amount of time a statement may run before the database cancels it. Zero means no limit.
+	StatementTimeout time.Duration
+
+	// The time zone that the DE database's timestamps without time zones are in. It's used as the session time zone
+	// so that the database converts those timestamps correctly. The server's TimeZone setting is used if it's empty.
+	// See SessionTimeZone.
+	TimeZone string
+
+	// How long to keep trying to connect to the database at startup before giving up.
+	ConnectTimeout time.Duration
+
+	// The delay before the first retry. The delay doubles after each failed attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+
+	// The longest delay between attempts to connect.
+	MaxBackoff time.Duration
+}
+
+// withRuntimeParameters adds run-time parameters to the connection string, which may either be a URL or a list of
+// key/value pairs. Parameters with empty values are left out.
+func withRuntimeParameters(uri string, params map[string]string) (string, error) {
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return uri, nil
+	}
+	sort.Strings(names)
+
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse the database URI: %w", err)
+		}
+		query := parsed.Query()
+		for _, name := range names {
+			query.Set(name, params[name])
+		}
+		parsed.RawQuery = query.Encode()
+		return parsed.String(), nil
+	}
+
+	for _, name := range names {
+		uri = fmt.Sprintf("%s %s=%s", uri, name, params[name])
+	}
+	return uri, nil
+}
+
+// Connect connects to the database and configures the connection pool. If the database can't be reached, the
+// connection is retried with an exponential backoff until settings.ConnectTimeout has passed, so that the service
+// survives the database being briefly unavailable, such as during a failover.
+func Connect(context context.Context, uri string, settings *ConnectionSettings) (*sqlx.DB, error) {
+	params := map[string]string{"timezone": settings.TimeZone}
+	if settings.StatementTimeout > 0 {
+		params["statement_timeout"] = fmt.Sprintf("%d", settings.StatementTimeout.Milliseconds())
+	}
+
+	uri, err := withRuntimeParameters(uri, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open doesn't connect to the database, so errors here are configuration problems that won't go away.
+	dbconn, err := sqlx.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn.SetMaxOpenConns(settings.MaxOpenConns)
+	dbconn.SetMaxIdleConns(settings.MaxIdleConns)
+	dbconn.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	dbconn.SetConnMaxIdleTime(settings.ConnMaxIdleTime)
+
+	deadline := time.Now().Add(settings.ConnectTimeout)
+	backoff := settings.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = dbconn.PingContext(context)
+		if err == nil {
+			return dbconn, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			dbconn.Close() // nolint: errcheck
+			return nil, fmt.Errorf("unable to connect to the database after %d attempts: %w", attempt, err)
+		}
+
+		log.WithError(err).Warnf("unable to connect to the database, retrying in %s", backoff)
+
+		select {
+		case <-context.Done():
+			dbconn.Close() // nolint: errcheck
+			return nil, context.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > settings.MaxBackoff {
+			backoff = settings.MaxBackoff
+		}
+	}
+}
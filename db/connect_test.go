@@ -0,0 +1,31 @@
+package db
+
+import "testing"
+
+func TestWithRuntimeParameters(t *testing.T) {
+	params := map[string]string{"timezone": "America/Phoenix", "statement_timeout": "30000", "unused": ""}
+
+	tests := []struct {
+		uri      string
+		expected string
+	}{
+		{
+			uri:      "postgresql://de:secret@db:5432/de?sslmode=disable",
+			expected: "postgresql://de:secret@db:5432/de?sslmode=disable&statement_timeout=30000&timezone=America%2FPhoenix",
+		},
+		{
+			uri:      "host=db dbname=de sslmode=disable",
+			expected: "host=db dbname=de sslmode=disable statement_timeout=30000 timezone=America/Phoenix",
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := withRuntimeParameters(test.uri, params)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if actual != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, actual)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/cockroachdb/apd"
@@ -49,6 +50,9 @@ type Queryer interface {
 	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
 }
 
+// Database provides access to the DE database. A *Database is safe for
+// concurrent use; transactions are scoped to the *Database passed to the
+// function given to WithTx, so concurrent callers never share one.
 type Database struct {
 	db DatabaseAccessor
 	tx TxAccessor
@@ -66,30 +70,40 @@ func (d *Database) Q() Queryer {
 	}
 }
 
-func (d *Database) Begin(context context.Context) error {
+// WithTx runs fn as a unit of work in a new transaction. The *Database passed
+// to fn runs all of its queries in the transaction, which is committed if fn
+// returns nil and rolled back otherwise, including when fn panics. If d is
+// already scoped to a transaction, fn runs in that transaction instead and the
+// caller that started it decides whether it's committed.
+func (d *Database) WithTx(context context.Context, fn func(tx *Database) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+
 	tx, err := d.db.BeginTxx(context, nil)
 	if err != nil {
 		return err
 	}
-	d.tx = tx
-	return nil
-}
 
-func (d *Database) Commit() error {
-	if d.tx != nil {
-		err := d.tx.Commit()
-		d.tx = nil
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			log.WithContext(context).WithError(rollbackErr).Error("failed to rollback transaction")
+		}
+	}()
+
+	if err = fn(&Database{db: d.db, tx: tx}); err != nil {
 		return err
 	}
-	return nil
-}
 
-func (d *Database) Rollback() error {
-	if d.tx != nil {
-		err := d.tx.Rollback()
-		d.tx = nil
+	if err = tx.Commit(); err != nil {
 		return err
 	}
+	committed = true
+
 	return nil
 }
 
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// txDriver is a database/sql driver that only supports transactions, counting how they end.
+type txDriver struct {
+	mu        sync.Mutex
+	commits   int
+	rollbacks int
+}
+
+func (d *txDriver) Open(_ string) (driver.Conn, error) { return &txConn{driver: d}, nil }
+
+func (d *txDriver) counts() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.commits, d.rollbacks
+}
+
+type txConn struct{ driver *txDriver }
+
+func (c *txConn) Prepare(_ string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *txConn) Close() error                          { return nil }
+func (c *txConn) Begin() (driver.Tx, error)             { return c, nil }
+
+func (c *txConn) Commit() error {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.commits++
+	return nil
+}
+
+func (c *txConn) Rollback() error {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.rollbacks++
+	return nil
+}
+
+type txConnector struct{ driver *txDriver }
+
+func (c txConnector) Connect(_ context.Context) (driver.Conn, error) { return c.driver.Open("") }
+func (c txConnector) Driver() driver.Driver                          { return c.driver }
+
+func newTestDatabase() (*Database, *txDriver) {
+	d := &txDriver{}
+	return New(sqlx.NewDb(sql.OpenDB(txConnector{driver: d}), "test")), d
+}
+
+func TestWithTx(t *testing.T) {
+	failure := errors.New("failure")
+
+	tests := []struct {
+		name      string
+		fn        func(tx *Database) error
+		commits   int
+		rollbacks int
+	}{
+		{name: "success", fn: func(_ *Database) error { return nil }, commits: 1},
+		{name: "error", fn: func(_ *Database) error { return failure }, rollbacks: 1},
+		{name: "panic", fn: func(_ *Database) error { panic(failure) }, rollbacks: 1},
+		{
+			name: "nested",
+			fn: func(tx *Database) error {
+				return tx.WithTx(context.Background(), func(_ *Database) error { return nil })
+			},
+			commits: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database, d := newTestDatabase()
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil && r != failure {
+						panic(r)
+					}
+				}()
+				_ = database.WithTx(context.Background(), test.fn)
+			}()
+
+			if commits, rollbacks := d.counts(); commits != test.commits || rollbacks != test.rollbacks {
+				t.Errorf("expected %d commits and %d rollbacks, got %d and %d", test.commits, test.rollbacks, commits, rollbacks)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// AnalysisUsageRecord summarizes the CPU hours charged for an analysis.
+type AnalysisUsageRecord struct {
+	AnalysisID   string    `db:"analysis_id"`
+	AnalysisName string    `db:"analysis_name"`
+	Username     string    `db:"username"`
+	UserID       string    `db:"user_id"`
+	AppID        string    `db:"app_id"`
+	JobType      string    `db:"job_type"`
+	SystemID     string    `db:"system_id"`
+	StartDate    null.Time `db:"start_date"`
+	EndDate      null.Time `db:"end_date"`
+	Steps        int       `db:"steps"`
+	CPUHours     float64   `db:"cpu_hours"`
+}
+
+// UserUsageRecord summarizes the CPU hours charged to a user and the adjustments made to them.
+type UserUsageRecord struct {
+	Username           string  `db:"username"`
+	UserID             string  `db:"user_id"`
+	Analyses           int     `db:"analyses"`
+	CalculatedCPUHours float64 `db:"calculated_cpu_hours"`
+	AddedCPUHours      float64 `db:"added_cpu_hours"`
+	SubtractedCPUHours float64 `db:"subtracted_cpu_hours"`
+	Resets             int     `db:"resets"`
+}
+
+// StreamAnalysisUsage calls fn for each analysis with CPU hours used from the start time up to, but not including, the
+// end time, according to the audit log. Usage is attributed to the time the charged span ended, which is recorded in
+// the audit entry's details, rather than the time it was charged, so usage that was charged late is exported with
+// the period it was used in. The records are read one at a time, so any number of them can be handled without
+// holding them all in memory. Usage charged before the audit log was added isn't included.
+func (d *Database) StreamAnalysisUsage(context context.Context, from, to time.Time, fn func(*AnalysisUsageRecord) error) error {
+	const q = `
+		SELECT
+			l.analysis_id,
+			j.job_name analysis_name,
+			l.username,
+			l.user_id,
+			j.app_id,
+			t.name job_type,
+			t.system_id,
+			j.start_date::timestamptz start_date,
+			j.end_date::timestamptz end_date,
+			count(DISTINCT l.external_id) steps,
+			sum(l.amount) cpu_hours
+		FROM usage_audit_log l
+		JOIN jobs j ON l.analysis_id = j.id
+		JOIN job_types t ON j.job_type_id = t.id
+		WHERE l.source IN ('calculation', 'recalculation')
+		AND coalesce((l.details->>'period_end')::timestamptz, l.recorded_at) >= $1
+		AND coalesce((l.details->>'period_end')::timestamptz, l.recorded_at) < $2
+		GROUP BY l.analysis_id, j.job_name, l.username, l.user_id, j.app_id, t.name, t.system_id, j.start_date, j.end_date
+		ORDER BY l.username, j.start_date, l.analysis_id;
+	`
+
+	rows, err := d.Q().QueryxContext(context, q, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	for rows.Next() {
+		var record AnalysisUsageRecord
+		if err = rows.StructScan(&record); err != nil {
+			return err
+		}
+		if err = fn(&record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// StreamUserUsage calls fn for each user with usage changes in the audit log from the start time up to, but not
+// including, the end time. Like StreamAnalysisUsage, calculated usage is attributed to the time the charged span
+// ended, the records are read one at a time, and usage charged before the audit log was added isn't included.
+// Adjustments are attributed to the time they were made.
+func (d *Database) StreamUserUsage(context context.Context, from, to time.Time, fn func(*UserUsageRecord) error) error {
+	const q = `
+		SELECT
+			username,
+			user_id,
+			count(DISTINCT analysis_id) analyses,
+			coalesce(sum(amount) FILTER (WHERE source <> 'adjustment'), 0) calculated_cpu_hours,
+			coalesce(sum(amount) FILTER (WHERE source = 'adjustment' AND operation = 'ADD'), 0) added_cpu_hours,
+			coalesce(sum(amount) FILTER (WHERE source = 'adjustment' AND operation = 'SUBTRACT'), 0) subtracted_cpu_hours,
+			count(*) FILTER (WHERE source = 'adjustment' AND operation = 'RESET') resets
+		FROM usage_audit_log
+		WHERE coalesce((details->>'period_end')::timestamptz, recorded_at) >= $1
+		AND coalesce((details->>'period_end')::timestamptz, recorded_at) < $2
+		GROUP BY username, user_id
+		ORDER BY username;
+	`
+
+	rows, err := d.Q().QueryxContext(context, q, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	for rows.Next() {
+		var record UserUsageRecord
+		if err = rows.StructScan(&record); err != nil {
+			return err
+		}
+		if err = fn(&record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
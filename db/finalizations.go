@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Finalization is an analysis step whose usage couldn't be finalized because it didn't have an end date yet.
+type Finalization struct {
+	AnalysisID    string    `db:"job_id" json:"analysis_id"`
+	ExternalID    string    `db:"external_id" json:"external_id"`
+	Attempts      int       `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+}
+
+// DeferFinalization schedules an analysis step to have its usage finalized later, once it has an end date.
+func (d *Database) DeferFinalization(context context.Context, analysisID, externalID string) error {
+	const q = `
+		INSERT INTO usage_finalizations (external_id, job_id)
+		VALUES ($1, $2)
+		ON CONFLICT (external_id) DO UPDATE
+		SET status = 'pending',
+		    error = NULL
+	`
+	_, err := d.Q().ExecContext(context, q, externalID, analysisID)
+	return err
+}
+
+// ClaimFinalizations returns up to limit pending finalizations that are due to be attempted. The attempt counts
+// of the returned finalizations are incremented and their next attempts are pushed back by the retry delay
+// multiplied by the number of attempts, so that other instances of the service don't pick them up at the same time.
+func (d *Database) ClaimFinalizations(context context.Context, limit int, retryDelay time.Duration) ([]Finalization, error) {
+	const q = `
+		UPDATE usage_finalizations
+		SET attempts = attempts + 1,
+		    next_attempt_at = now() + (attempts + 1) * $2 * interval '1 second'
+		WHERE external_id IN (
+			SELECT external_id
+			FROM usage_finalizations
+			WHERE status = 'pending'
+			AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING job_id, external_id, attempts, next_attempt_at
+	`
+	rows, err := d.Q().QueryxContext(context, q, limit, retryDelay.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	finalizations := make([]Finalization, 0)
+	for rows.Next() {
+		var f Finalization
+		if err = rows.StructScan(&f); err != nil {
+			return nil, err
+		}
+		finalizations = append(finalizations, f)
+	}
+
+	return finalizations, rows.Err()
+}
+
+// CompleteFinalization removes an analysis step from the list of pending finalizations after its usage was
+// finalized using its actual end date.
+func (d *Database) CompleteFinalization(context context.Context, externalID string) error {
+	const q = `
+		DELETE FROM usage_finalizations
+		WHERE external_id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, externalID)
+	return err
+}
+
+// RecordFinalizationFallback records that an analysis step's usage was finalized using a substitute for the end
+// date so that the usage can be corrected later.
+func (d *Database) RecordFinalizationFallback(context context.Context, externalID string, fallbackEnd time.Time) error {
+	const q = `
+		UPDATE usage_finalizations
+		SET status = 'fallback',
+		    fallback_end = $2
+		WHERE external_id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, externalID, fallbackEnd.UTC())
+	return err
+}
+
+// FailFinalization records that an analysis step's usage couldn't be finalized, along with the reason, so that it
+// isn't attempted again.
+func (d *Database) FailFinalization(context context.Context, externalID, reason string) error {
+	const q = `
+		UPDATE usage_finalizations
+		SET status = 'failed',
+		    error = $2
+		WHERE external_id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, externalID, reason)
+	return err
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+)
+
+// UsageGroup is a group of users whose usage is summed, such as a lab that shares an allocation. Usernames include
+// the domain suffix.
+type UsageGroup struct {
+	Name          string         `db:"name" json:"name"`
+	CPUHoursQuota null.Float     `db:"cpu_hours_quota" json:"cpu_hours_quota"`
+	Members       pq.StringArray `db:"members" json:"members"`
+	UpdatedAt     null.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// UsageGroup returns the group with the given name. sql.ErrNoRows is returned if there's no such group.
+func (d *Database) UsageGroup(context context.Context, name string) (*UsageGroup, error) {
+	var group UsageGroup
+
+	const q = `
+		SELECT
+			g.name,
+			g.cpu_hours_quota,
+			g.updated_at,
+			COALESCE(
+				array_agg(m.username ORDER BY m.username) FILTER (WHERE m.username IS NOT NULL),
+				'{}'
+			) members
+		FROM usage_groups g
+		LEFT JOIN usage_group_members m ON g.name = m.group_name
+		WHERE g.name = $1
+		GROUP BY g.name;
+	`
+
+	if err := d.Q().QueryRowxContext(context, q, name).StructScan(&group); err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// SetUsageGroup creates the group or replaces its quota and members.
+func (d *Database) SetUsageGroup(context context.Context, group *UsageGroup) error {
+	const upsertGroup = `
+		INSERT INTO usage_groups (name, cpu_hours_quota)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET cpu_hours_quota = EXCLUDED.cpu_hours_quota,
+			updated_at = now()
+		RETURNING updated_at
+	`
+	const deleteMembers = `
+		DELETE FROM usage_group_members
+		WHERE group_name = $1
+	`
+	const insertMembers = `
+		INSERT INTO usage_group_members (group_name, username)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT DO NOTHING
+	`
+
+	return d.WithTx(context, func(tx *Database) error {
+		var updatedAt time.Time
+		if err := tx.Q().QueryRowxContext(context, upsertGroup, group.Name, group.CPUHoursQuota).Scan(&updatedAt); err != nil {
+			return err
+		}
+		group.UpdatedAt = null.TimeFrom(updatedAt)
+
+		if _, err := tx.Q().ExecContext(context, deleteMembers, group.Name); err != nil {
+			return err
+		}
+
+		_, err := tx.Q().ExecContext(context, insertMembers, group.Name, group.Members)
+		return err
+	})
+}
+
+// DeleteUsageGroup deletes the group with the given name. sql.ErrNoRows is returned if there's no such group.
+func (d *Database) DeleteUsageGroup(context context.Context, name string) error {
+	const q = `
+		DELETE FROM usage_groups
+		WHERE name = $1
+	`
+
+	result, err := d.Q().ExecContext(context, q, name)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// CurrentCPUHoursForUsers returns the CPU hours that each of the users has used in their current usage periods,
+// keyed by username. Users who haven't used any CPU hours during a current usage period aren't included.
+func (d *Database) CurrentCPUHoursForUsers(context context.Context, usernames []string) (map[string]float64, error) {
+	const q = `
+		SELECT u.username, t.total::float8
+		FROM cpu_usage_totals t
+		JOIN users u ON t.user_id = u.id
+		WHERE u.username = ANY($1)
+		AND t.effective_range @> CURRENT_TIMESTAMP::timestamp;
+	`
+
+	rows, err := d.Q().QueryxContext(context, q, pq.StringArray(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]float64)
+	for rows.Next() {
+		var (
+			username string
+			total    float64
+		)
+		if err = rows.Scan(&username, &total); err != nil {
+			return nil, err
+		}
+		totals[username] += total
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,335 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/guregu/null"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrIncompatibleSchema is returned when the database schema isn't the version that this version of the service
+// requires.
+var ErrIncompatibleSchema = errors.New("incompatible database schema")
+
+// Migration is a versioned change to the database schema. Migrations are embedded in the service and applied in
+// version order.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus describes whether a migration has been applied to the database. Migrations that were applied by a
+// newer version of the service are unknown to this one.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt null.Time
+	Unknown   bool
+}
+
+// migrationFilePattern matches the names of migration files, such as 000001_de_baseline.up.sql.
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLockID identifies the advisory lock that keeps more than one instance of the service from migrating the
+// database at the same time.
+const migrationLockID = 0x7265736f75726365
+
+// Migrations returns the embedded migrations in version order. Every migration must have both an up and a down file.
+func Migrations() ([]*Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has more than one name", version)
+		}
+
+		if match[3] == "up" {
+			migration.up = string(contents)
+		} else {
+			migration.down = string(contents)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.up == "" || migration.down == "" {
+			return nil, fmt.Errorf("migration %d must have both an up and a down file", migration.Version)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates the table that records which migrations have been applied.
+func (d *Database) ensureMigrationsTable(context context.Context) error {
+	const q = `
+		CREATE TABLE IF NOT EXISTS resource_usage_api_migrations (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamp with time zone NOT NULL DEFAULT now()
+		)
+	`
+	_, err := d.Q().ExecContext(context, q)
+	return err
+}
+
+// lockMigrations waits for any other instance of the service that's migrating the database to finish. The lock is
+// released when the transaction ends, so d must be scoped to a transaction.
+func (d *Database) lockMigrations(context context.Context) error {
+	_, err := d.Q().ExecContext(context, "SELECT pg_advisory_xact_lock($1)", migrationLockID)
+	return err
+}
+
+// MigrationStatuses returns the status of each embedded migration along with any migrations that were applied by a
+// newer version of the service, in version order.
+func (d *Database) MigrationStatuses(context context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	const existsQuery = `SELECT to_regclass('resource_usage_api_migrations') IS NOT NULL`
+	if err = d.Q().QueryRowxContext(context, existsQuery).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]MigrationStatus)
+	if exists {
+		const q = `
+			SELECT version, name, applied_at
+			FROM resource_usage_api_migrations
+		`
+
+		rows, err := d.Q().QueryxContext(context, q)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close() // nolint: errcheck
+
+		for rows.Next() {
+			var status MigrationStatus
+			if err = rows.Scan(&status.Version, &status.Name, &status.AppliedAt); err != nil {
+				return nil, err
+			}
+			status.Unknown = true
+			applied[status.Version] = status
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if recorded, ok := applied[migration.Version]; ok {
+			status.AppliedAt = recorded.AppliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, unknown := range applied {
+		statuses = append(statuses, unknown)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// MigrateUp applies each of the embedded migrations that hasn't been applied yet, in version order, and returns the
+// ones that were applied. Each migration runs in its own transaction.
+func (d *Database) MigrateUp(context context.Context) ([]*Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.ensureMigrationsTable(context); err != nil {
+		return nil, err
+	}
+
+	var applied []*Migration
+	for _, migration := range migrations {
+		var ran bool
+
+		err = d.WithTx(context, func(tx *Database) error {
+			if err := tx.lockMigrations(context); err != nil {
+				return err
+			}
+
+			// Another instance may have applied the migration while this one was waiting for the lock.
+			var done bool
+			const checkQuery = `SELECT EXISTS (SELECT 1 FROM resource_usage_api_migrations WHERE version = $1)`
+			if err := tx.Q().QueryRowxContext(context, checkQuery, migration.Version).Scan(&done); err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+
+			if _, err := tx.Q().ExecContext(context, migration.up); err != nil {
+				return fmt.Errorf("unable to apply migration %d (%s): %w", migration.Version, migration.Name, err)
+			}
+
+			const recordQuery = `INSERT INTO resource_usage_api_migrations (version, name) VALUES ($1, $2)`
+			if _, err := tx.Q().ExecContext(context, recordQuery, migration.Version, migration.Name); err != nil {
+				return err
+			}
+
+			ran = true
+			return nil
+		})
+		if err != nil {
+			return applied, err
+		}
+
+		if ran {
+			log.WithContext(context).Infof("applied migration %d (%s)", migration.Version, migration.Name)
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts up to the given number of the most recently applied migrations and returns the ones that were
+// reverted. Each migration runs in its own transaction. Migrations applied by a newer version of the service can't be
+// reverted by this one.
+func (d *Database) MigrateDown(context context.Context, steps int) ([]*Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration, len(migrations))
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+
+	if err = d.ensureMigrationsTable(context); err != nil {
+		return nil, err
+	}
+
+	var reverted []*Migration
+	for i := 0; i < steps; i++ {
+		var migration *Migration
+
+		err = d.WithTx(context, func(tx *Database) error {
+			if err := tx.lockMigrations(context); err != nil {
+				return err
+			}
+
+			var version null.Int
+			const latestQuery = `SELECT max(version) FROM resource_usage_api_migrations`
+			if err := tx.Q().QueryRowxContext(context, latestQuery).Scan(&version); err != nil {
+				return err
+			}
+			if !version.Valid {
+				return nil
+			}
+
+			var ok bool
+			if migration, ok = byVersion[int(version.Int64)]; !ok {
+				return fmt.Errorf(
+					"%w: migration %d was applied by a newer version of the service",
+					ErrIncompatibleSchema,
+					version.Int64,
+				)
+			}
+
+			if _, err := tx.Q().ExecContext(context, migration.down); err != nil {
+				return fmt.Errorf("unable to revert migration %d (%s): %w", migration.Version, migration.Name, err)
+			}
+
+			const deleteQuery = `DELETE FROM resource_usage_api_migrations WHERE version = $1`
+			_, err := tx.Q().ExecContext(context, deleteQuery, migration.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, err
+		}
+
+		// There was nothing left to revert.
+		if migration == nil {
+			break
+		}
+
+		log.WithContext(context).Infof("reverted migration %d (%s)", migration.Version, migration.Name)
+		reverted = append(reverted, migration)
+	}
+
+	return reverted, nil
+}
+
+// CheckSchemaVersion returns ErrIncompatibleSchema if any of the embedded migrations hasn't been applied. Migrations
+// that were applied by a newer version of the service are logged as warnings, so that an older version can still run
+// during a rolling deployment or a rollback.
+func (d *Database) CheckSchemaVersion(context context.Context) error {
+	statuses, err := d.MigrationStatuses(context)
+	if err != nil {
+		return err
+	}
+
+	return checkMigrationStatuses(context, statuses)
+}
+
+// checkMigrationStatuses returns ErrIncompatibleSchema for the first migration that hasn't been applied and logs a
+// warning for each migration that was applied by a newer version of the service.
+func checkMigrationStatuses(context context.Context, statuses []MigrationStatus) error {
+	for _, status := range statuses {
+		switch {
+		case status.Unknown:
+			log.WithContext(context).Warnf(
+				"migration %d (%s) was applied by a newer version of the service",
+				status.Version,
+				status.Name,
+			)
+		case !status.AppliedAt.Valid:
+			return fmt.Errorf(
+				"%w: migration %d (%s) hasn't been applied; run the migrate up subcommand",
+				ErrIncompatibleSchema,
+				status.Version,
+				status.Name,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("unable to load the embedded migrations: %s", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+
+	if migrations[0].Name != "de_baseline" {
+		t.Errorf("expected the DE baseline to be the first migration, got %s", migrations[0].Name)
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration %d to have version %d, got %d", i, i+1, migration.Version)
+		}
+		if strings.TrimSpace(migration.up) == "" || strings.TrimSpace(migration.down) == "" {
+			t.Errorf("migration %d has an empty up or down file", migration.Version)
+		}
+	}
+}
+
+func TestCheckMigrationStatuses(t *testing.T) {
+	applied := null.TimeFrom(time.Now())
+
+	tests := []struct {
+		name       string
+		statuses   []MigrationStatus
+		compatible bool
+	}{
+		{
+			name:       "all applied",
+			statuses:   []MigrationStatus{{Version: 1, AppliedAt: applied}, {Version: 2, AppliedAt: applied}},
+			compatible: true,
+		},
+		{
+			name: "newer migrations",
+			statuses: []MigrationStatus{
+				{Version: 1, AppliedAt: applied},
+				{Version: 2, AppliedAt: applied, Unknown: true},
+			},
+			compatible: true,
+		},
+		{
+			name:     "missing migration",
+			statuses: []MigrationStatus{{Version: 1, AppliedAt: applied}, {Version: 2}},
+		},
+		{
+			name: "missing and newer migrations",
+			statuses: []MigrationStatus{
+				{Version: 1},
+				{Version: 2, AppliedAt: applied, Unknown: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMigrationStatuses(context.Background(), test.statuses)
+			if test.compatible && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !test.compatible && !errors.Is(err, ErrIncompatibleSchema) {
+				t.Errorf("expected an ErrIncompatibleSchema, got %v", err)
+			}
+		})
+	}
+}
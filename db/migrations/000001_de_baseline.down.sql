@@ -0,0 +1,2 @@
+-- The baseline only checks the DE's tables, so there's nothing to revert.
+SELECT 1;
@@ -0,0 +1,56 @@
+-- The parts of the DE's schema that this service reads or writes. The DE owns
+-- these tables, so they're only checked here: the migration fails, naming what's
+-- missing, if any of the tables or columns that the service depends on doesn't
+-- exist.
+DO $$
+DECLARE
+    missing text;
+BEGIN
+    SELECT string_agg(required.table_name || '.' || required.column_name, ', ')
+    INTO missing
+    FROM (
+        VALUES
+            ('users', 'id'),
+            ('users', 'username'),
+            ('job_types', 'id'),
+            ('job_types', 'name'),
+            ('job_types', 'system_id'),
+            ('jobs', 'id'),
+            ('jobs', 'job_name'),
+            ('jobs', 'app_id'),
+            ('jobs', 'job_type_id'),
+            ('jobs', 'user_id'),
+            ('jobs', 'subdomain'),
+            ('jobs', 'submission'),
+            ('jobs', 'status'),
+            ('jobs', 'deleted'),
+            ('jobs', 'start_date'),
+            ('jobs', 'end_date'),
+            ('jobs', 'usage_last_update'),
+            ('jobs', 'millicores_reserved'),
+            ('job_steps', 'job_id'),
+            ('job_steps', 'step_number'),
+            ('job_steps', 'external_id'),
+            ('job_steps', 'start_date'),
+            ('job_steps', 'end_date'),
+            ('job_steps', 'status'),
+            ('job_steps', 'job_type_id'),
+            ('cpu_usage_totals', 'id'),
+            ('cpu_usage_totals', 'user_id'),
+            ('cpu_usage_totals', 'total'),
+            ('cpu_usage_totals', 'effective_range'),
+            ('cpu_usage_totals', 'last_modified')
+    ) AS required (table_name, column_name)
+    WHERE NOT EXISTS (
+        SELECT 1
+        FROM information_schema.columns c
+        WHERE c.table_schema = ANY (current_schemas(false))
+          AND c.table_name = required.table_name
+          AND c.column_name = required.column_name
+    );
+
+    IF missing IS NOT NULL THEN
+        RAISE EXCEPTION 'the DE schema is missing columns that the service requires: %', missing;
+    END IF;
+END
+$$;
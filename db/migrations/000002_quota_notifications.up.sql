@@ -0,0 +1,9 @@
+-- Records the usage threshold notifications that have been sent so that each
+-- threshold only fires once per subscription period.
+CREATE TABLE IF NOT EXISTS quota_notifications (
+    subscription_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    threshold numeric NOT NULL,
+    sent_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id, resource_type, threshold)
+);
@@ -0,0 +1,9 @@
+-- Records when a user's usage first exceeded their quota during a subscription
+-- period, which is used to determine when the enforcement grace period ends.
+CREATE TABLE IF NOT EXISTS quota_overages (
+    subscription_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    first_exceeded_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_checked_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id, resource_type)
+);
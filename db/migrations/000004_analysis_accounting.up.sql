@@ -0,0 +1,10 @@
+-- Tracks the job status updates that matter for accounting. started_at is when
+-- the analysis actually started consuming resources, and is used as the basis
+-- for usage calculations when it's available.
+CREATE TABLE IF NOT EXISTS analysis_accounting (
+    job_id uuid PRIMARY KEY,
+    submitted_at timestamp with time zone,
+    started_at timestamp with time zone,
+    finished_at timestamp with time zone,
+    final_state text
+);
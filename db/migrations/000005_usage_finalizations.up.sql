@@ -0,0 +1,16 @@
+-- Analyses whose usage couldn't be finalized because they didn't have an end
+-- date yet. Pending rows are retried by the finalization sweeper. Rows with the
+-- 'fallback' status were finalized with a substitute end date and are kept so
+-- that their usage can be corrected later.
+CREATE TABLE IF NOT EXISTS usage_finalizations (
+    job_id uuid PRIMARY KEY,
+    status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'fallback')),
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone NOT NULL DEFAULT now(),
+    fallback_end timestamp with time zone,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS usage_finalizations_pending_index
+    ON usage_finalizations (next_attempt_at)
+    WHERE status = 'pending';
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS usage_finalizations_job_id_index;
+ALTER TABLE usage_finalizations DROP CONSTRAINT IF EXISTS usage_finalizations_pkey;
+DELETE FROM usage_finalizations a
+USING usage_finalizations b
+WHERE a.job_id = b.job_id
+AND a.external_id < b.external_id;
+ALTER TABLE usage_finalizations ADD PRIMARY KEY (job_id);
+ALTER TABLE usage_finalizations DROP COLUMN IF EXISTS external_id;
+
+ALTER TABLE job_steps DROP COLUMN IF EXISTS millicores_reserved;
+ALTER TABLE job_steps DROP COLUMN IF EXISTS usage_last_update;
@@ -0,0 +1,25 @@
+-- Each step of an analysis is accounted for separately. Steps without their
+-- own reservation use the reservation of the analysis.
+ALTER TABLE job_steps ADD COLUMN IF NOT EXISTS usage_last_update timestamp;
+ALTER TABLE job_steps ADD COLUMN IF NOT EXISTS millicores_reserved bigint;
+
+-- Pending finalizations are tracked per step rather than per analysis. Existing
+-- rows are assigned to the last step of their analysis.
+ALTER TABLE usage_finalizations ADD COLUMN IF NOT EXISTS external_id text;
+
+UPDATE usage_finalizations f
+SET external_id = (
+    SELECT s.external_id
+    FROM job_steps s
+    WHERE s.job_id = f.job_id
+    ORDER BY s.step_number DESC
+    LIMIT 1
+)
+WHERE f.external_id IS NULL;
+
+DELETE FROM usage_finalizations WHERE external_id IS NULL;
+
+ALTER TABLE usage_finalizations DROP CONSTRAINT IF EXISTS usage_finalizations_pkey;
+ALTER TABLE usage_finalizations ALTER COLUMN external_id SET NOT NULL;
+ALTER TABLE usage_finalizations ADD PRIMARY KEY (external_id);
+CREATE INDEX IF NOT EXISTS usage_finalizations_job_id_index ON usage_finalizations (job_id);
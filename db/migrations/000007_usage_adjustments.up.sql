@@ -0,0 +1,15 @@
+-- Manual adjustments to users' usage made by administrators, along with who
+-- made them and why. event_type is one of the cpu.hours.* event types.
+CREATE TABLE IF NOT EXISTS usage_adjustments (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    event_type text NOT NULL CHECK (event_type IN ('cpu.hours.add', 'cpu.hours.subtract', 'cpu.hours.reset')),
+    amount numeric NOT NULL CHECK (amount >= 0),
+    reason text NOT NULL CHECK (reason <> ''),
+    actor text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS usage_adjustments_user_index
+    ON usage_adjustments (user_id, created_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS usage_audit_log;
+DROP FUNCTION IF EXISTS usage_audit_log_append_only();
@@ -0,0 +1,32 @@
+-- An append-only record of every change made to users' usage, whether it was
+-- calculated from an analysis, made by an administrator, or made by a
+-- recalculation or backfill.
+CREATE TABLE IF NOT EXISTS usage_audit_log (
+    id bigserial PRIMARY KEY,
+    user_id uuid NOT NULL,
+    username text NOT NULL,
+    analysis_id uuid,
+    external_id text,
+    resource_type text NOT NULL,
+    source text NOT NULL CHECK (source IN ('calculation', 'adjustment', 'recalculation', 'backfill')),
+    operation text NOT NULL,
+    amount numeric NOT NULL,
+    actor text NOT NULL,
+    details jsonb,
+    recorded_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS usage_audit_log_user_index ON usage_audit_log (user_id, recorded_at);
+CREATE INDEX IF NOT EXISTS usage_audit_log_analysis_index ON usage_audit_log (analysis_id);
+CREATE INDEX IF NOT EXISTS usage_audit_log_actor_index ON usage_audit_log (actor, recorded_at);
+
+CREATE OR REPLACE FUNCTION usage_audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'usage_audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS usage_audit_log_append_only ON usage_audit_log;
+CREATE TRIGGER usage_audit_log_append_only
+    BEFORE UPDATE OR DELETE ON usage_audit_log
+    FOR EACH ROW EXECUTE FUNCTION usage_audit_log_append_only();
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS cpu_usage_samples;
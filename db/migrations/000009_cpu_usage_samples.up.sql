@@ -0,0 +1,9 @@
+-- Samples of the CPU actually used by analyses, imported from the metrics
+-- system. They're compared to the reservations to see how efficiently
+-- analyses use the CPUs they request.
+CREATE TABLE IF NOT EXISTS cpu_usage_samples (
+    job_id uuid NOT NULL,
+    sampled_at timestamp with time zone NOT NULL,
+    millicores_used numeric NOT NULL CHECK (millicores_used >= 0),
+    PRIMARY KEY (job_id, sampled_at)
+);
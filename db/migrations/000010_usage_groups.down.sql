@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS usage_group_members;
+DROP TABLE IF EXISTS usage_groups;
@@ -0,0 +1,16 @@
+-- Groups of users whose usage is summed, such as labs that share an
+-- allocation. Groups can also be defined in the configuration file. Usernames
+-- include the domain suffix.
+CREATE TABLE IF NOT EXISTS usage_groups (
+    name text PRIMARY KEY CHECK (name <> ''),
+    cpu_hours_quota numeric CHECK (cpu_hours_quota > 0),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS usage_group_members (
+    group_name text NOT NULL REFERENCES usage_groups (name) ON DELETE CASCADE,
+    username text NOT NULL,
+    PRIMARY KEY (group_name, username)
+);
+
+CREATE INDEX IF NOT EXISTS usage_group_members_username_index ON usage_group_members (username);
@@ -0,0 +1,3 @@
+ALTER TABLE job_steps
+    ALTER COLUMN usage_last_update TYPE timestamp
+    USING usage_last_update AT TIME ZONE current_setting('TimeZone');
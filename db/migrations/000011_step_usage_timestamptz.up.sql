@@ -0,0 +1,7 @@
+-- The usage last update time for steps was stored in the time zone of the
+-- service without recording which zone that was. It's converted using the
+-- session time zone, so run this with the session time zone set to the zone
+-- the service ran in (normally UTC).
+ALTER TABLE job_steps
+    ALTER COLUMN usage_last_update TYPE timestamp with time zone
+    USING usage_last_update AT TIME ZONE current_setting('TimeZone');
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS quota_overages_first_exceeded_at_index;
+
+ALTER TABLE quota_overages
+    DROP COLUMN IF EXISTS user_id,
+    DROP COLUMN IF EXISTS username;
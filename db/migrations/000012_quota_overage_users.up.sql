@@ -0,0 +1,8 @@
+-- Records whose usage is over quota, so that overages can be checked again
+-- when the grace period ends even if no new usage is recorded for the user.
+-- Existing rows are filled in the next time usage is recorded for the user.
+ALTER TABLE quota_overages
+    ADD COLUMN IF NOT EXISTS username text,
+    ADD COLUMN IF NOT EXISTS user_id uuid;
+
+CREATE INDEX IF NOT EXISTS quota_overages_first_exceeded_at_index ON quota_overages (first_exceeded_at);
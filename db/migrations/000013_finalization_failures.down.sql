@@ -0,0 +1,7 @@
+DELETE FROM usage_finalizations WHERE status = 'failed';
+
+ALTER TABLE usage_finalizations DROP COLUMN IF EXISTS error;
+
+ALTER TABLE usage_finalizations DROP CONSTRAINT IF EXISTS usage_finalizations_status_check;
+ALTER TABLE usage_finalizations
+    ADD CONSTRAINT usage_finalizations_status_check CHECK (status IN ('pending', 'fallback'));
@@ -0,0 +1,8 @@
+-- Steps whose usage still can't be finalized after the maximum number of
+-- attempts, for reasons other than a missing end date, are marked as failed
+-- along with the last error so that they can be investigated.
+ALTER TABLE usage_finalizations DROP CONSTRAINT IF EXISTS usage_finalizations_status_check;
+ALTER TABLE usage_finalizations
+    ADD CONSTRAINT usage_finalizations_status_check CHECK (status IN ('pending', 'fallback', 'failed'));
+
+ALTER TABLE usage_finalizations ADD COLUMN IF NOT EXISTS error text;
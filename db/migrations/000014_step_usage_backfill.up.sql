@@ -0,0 +1,18 @@
+-- Steps are charged from their own usage last update time rather than the
+-- analysis's. Analyses that were only charged before usage was accounted for
+-- per step don't have the time on any of their steps, so it's copied from the
+-- analysis to keep that usage from being charged again. Steps that ended
+-- before the analysis was last charged get their own end date instead.
+UPDATE job_steps s
+SET usage_last_update = LEAST(j.usage_last_update::timestamptz, COALESCE(s.end_date::timestamptz, j.usage_last_update::timestamptz))
+FROM jobs j
+WHERE s.job_id = j.id
+AND j.usage_last_update IS NOT NULL
+AND s.usage_last_update IS NULL
+AND s.start_date::timestamptz <= j.usage_last_update::timestamptz
+AND NOT EXISTS (
+    SELECT 1
+    FROM job_steps charged
+    WHERE charged.job_id = j.id
+    AND charged.usage_last_update IS NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE quota_overages DROP COLUMN IF EXISTS signalled_at;
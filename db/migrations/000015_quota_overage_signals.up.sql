@@ -0,0 +1,4 @@
+-- Records when each overage was last signalled, so that the users' running
+-- analyses are only signalled once per subscription period instead of on every
+-- sweep. Analyses started after the last signal are signalled separately.
+ALTER TABLE quota_overages ADD COLUMN IF NOT EXISTS signalled_at timestamp with time zone;
@@ -0,0 +1,7 @@
+DELETE FROM usage_adjustments WHERE status = 'failed';
+
+ALTER TABLE usage_adjustments DROP CONSTRAINT IF EXISTS usage_adjustments_status_check;
+
+ALTER TABLE usage_adjustments
+    DROP COLUMN IF EXISTS error,
+    DROP COLUMN IF EXISTS status;
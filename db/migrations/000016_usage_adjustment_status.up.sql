@@ -0,0 +1,14 @@
+-- Adjustments are recorded before they're sent to QMS, so that an adjustment
+-- that QMS accepts is never lost because the database write that follows it
+-- fails. The status records whether QMS accepted the adjustment, and the error
+-- is kept for adjustments that it didn't. Adjustments made before this
+-- migration were only recorded once QMS had accepted them.
+ALTER TABLE usage_adjustments
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'applied',
+    ADD COLUMN IF NOT EXISTS error text;
+
+ALTER TABLE usage_adjustments ALTER COLUMN status SET DEFAULT 'pending';
+
+ALTER TABLE usage_adjustments DROP CONSTRAINT IF EXISTS usage_adjustments_status_check;
+ALTER TABLE usage_adjustments
+    ADD CONSTRAINT usage_adjustments_status_check CHECK (status IN ('pending', 'applied', 'failed'));
@@ -0,0 +1,37 @@
+package db
+
+import "context"
+
+// RecordQuotaNotification records that the notification for a usage threshold has been sent for a subscription
+// period. Returns false if the notification had already been recorded, meaning it shouldn't be sent again.
+func (d *Database) RecordQuotaNotification(context context.Context, subscriptionID, resourceType string, threshold float64) (bool, error) {
+	const q = `
+		INSERT INTO quota_notifications (subscription_id, resource_type, threshold)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (subscription_id, resource_type, threshold) DO NOTHING
+	`
+	result, err := d.Q().ExecContext(context, q, subscriptionID, resourceType, threshold)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// DeleteQuotaNotification removes the record of a threshold notification so that it will be sent again the next
+// time the threshold is checked. Used when sending the notification fails.
+func (d *Database) DeleteQuotaNotification(context context.Context, subscriptionID, resourceType string, threshold float64) error {
+	const q = `
+		DELETE FROM quota_notifications
+		WHERE subscription_id = $1
+		AND resource_type = $2
+		AND threshold = $3
+	`
+	_, err := d.Q().ExecContext(context, q, subscriptionID, resourceType, threshold)
+	return err
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+)
+
+// RunningAnalysis contains the information needed to identify one of a user's running analyses.
+type RunningAnalysis struct {
+	ID          string         `db:"id" json:"id"`
+	Name        string         `db:"job_name" json:"name"`
+	AppID       string         `db:"app_id" json:"app_id"`
+	JobType     string         `db:"job_type" json:"job_type"`
+	SystemID    string         `db:"system_id" json:"system_id"`
+	StartDate   time.Time      `db:"start_date" json:"start_date"`
+	ExternalIDs pq.StringArray `db:"external_ids" json:"external_ids"`
+}
+
+// RunningAnalyses returns the analyses that are currently running for the user.
+func (d *Database) RunningAnalyses(context context.Context, userID string) ([]RunningAnalysis, error) {
+	const q = `
+		SELECT
+			j.id,
+			j.job_name,
+			j.app_id,
+			t.name job_type,
+			t.system_id,
+			j.start_date::timestamptz start_date,
+			array_remove(array_agg(s.external_id ORDER BY s.step_number), NULL) external_ids
+		FROM jobs j
+		JOIN job_types t ON j.job_type_id = t.id
+		LEFT JOIN job_steps s ON s.job_id = j.id
+		WHERE j.user_id = $1
+		AND j.status = 'Running'
+		AND NOT j.deleted
+		GROUP BY j.id, t.name, t.system_id
+		ORDER BY j.start_date;
+	`
+	rows, err := d.Q().QueryxContext(context, q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	analyses := make([]RunningAnalysis, 0)
+	for rows.Next() {
+		var analysis RunningAnalysis
+		if err = rows.StructScan(&analysis); err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	return analyses, rows.Err()
+}
+
+// QuotaOverage records when a user's usage of a resource type first exceeded the quota during a subscription period.
+type QuotaOverage struct {
+	SubscriptionID  string    `db:"subscription_id"`
+	ResourceType    string    `db:"resource_type"`
+	Username        string    `db:"username"`
+	UserID          string    `db:"user_id"`
+	FirstExceededAt time.Time `db:"first_exceeded_at"`
+	SignalledAt     null.Time `db:"signalled_at"`
+}
+
+// RecordQuotaOverage records that the user's usage of a resource type exceeded the quota during a subscription
+// period and returns the overage. The first recorded time is kept if the overage had already been recorded.
+func (d *Database) RecordQuotaOverage(context context.Context, subscriptionID, resourceType, username, userID string) (*QuotaOverage, error) {
+	const q = `
+		INSERT INTO quota_overages (subscription_id, resource_type, username, user_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subscription_id, resource_type)
+		DO UPDATE SET last_checked_at = now(), username = EXCLUDED.username, user_id = EXCLUDED.user_id
+		RETURNING subscription_id, resource_type, username, user_id, first_exceeded_at, signalled_at
+	`
+	var overage QuotaOverage
+	err := d.Q().QueryRowxContext(context, q, subscriptionID, resourceType, username, userID).StructScan(&overage)
+	if err != nil {
+		return nil, err
+	}
+	return &overage, nil
+}
+
+// ExpiredQuotaOverages returns the recorded overages whose grace period has ended. Overages recorded before the
+// user was stored with them are skipped until usage is recorded for the user again.
+func (d *Database) ExpiredQuotaOverages(context context.Context, gracePeriod time.Duration) ([]QuotaOverage, error) {
+	const q = `
+		SELECT subscription_id, resource_type, username, user_id, first_exceeded_at, signalled_at
+		FROM quota_overages
+		WHERE first_exceeded_at <= now() - $1 * interval '1 second'
+		AND username IS NOT NULL
+		AND user_id IS NOT NULL
+		ORDER BY first_exceeded_at
+	`
+	rows, err := d.Q().QueryxContext(context, q, gracePeriod.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	overages := make([]QuotaOverage, 0)
+	for rows.Next() {
+		var overage QuotaOverage
+		if err = rows.StructScan(&overage); err != nil {
+			return nil, err
+		}
+		overages = append(overages, overage)
+	}
+
+	return overages, rows.Err()
+}
+
+// ClearQuotaOverage removes the record of a user's usage of a resource type exceeding their quota. Used when the
+// usage drops back below the quota, for example after the quota is increased.
+func (d *Database) ClearQuotaOverage(context context.Context, subscriptionID, resourceType string) error {
+	const q = `
+		DELETE FROM quota_overages
+		WHERE subscription_id = $1
+		AND resource_type = $2
+	`
+	_, err := d.Q().ExecContext(context, q, subscriptionID, resourceType)
+	return err
+}
+
+// MarkQuotaOverageSignalled records when an overage was signalled, as long as it hasn't been signalled by another
+// instance since it was read. Returns false if it has, meaning the signal shouldn't be sent. Passing the time that
+// was just recorded as previous and the time that was read as signalledAt undoes the change.
+func (d *Database) MarkQuotaOverageSignalled(context context.Context, subscriptionID, resourceType string, previous, signalledAt null.Time) (bool, error) {
+	const q = `
+		UPDATE quota_overages
+		SET signalled_at = $4
+		WHERE subscription_id = $1
+		AND resource_type = $2
+		AND signalled_at IS NOT DISTINCT FROM $3
+	`
+	result, err := d.Q().ExecContext(context, q, subscriptionID, resourceType, previous, signalledAt)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ReportDimension is what usage is grouped by in a report.
+type ReportDimension string
+
+const (
+	// ReportByUser groups usage by username.
+	ReportByUser ReportDimension = "username"
+
+	// ReportByApp groups usage by app ID.
+	ReportByApp ReportDimension = "app_id"
+
+	// ReportBySystem groups usage by system ID.
+	ReportBySystem ReportDimension = "system_id"
+)
+
+// UsageRank contains the usage attributed to a user, app, or system in a report.
+type UsageRank struct {
+	Name      string             `json:"name"`
+	Analyses  int                `json:"analyses"`
+	CPUHours  float64            `json:"cpu_hours"`
+	ByJobType map[string]float64 `json:"by_job_type"`
+	BySystem  map[string]float64 `json:"by_system"`
+}
+
+// usageBreakdown is a row of the top consumers query.
+type usageBreakdown struct {
+	Name     string  `db:"name"`
+	JobType  string  `db:"job_type"`
+	SystemID string  `db:"system_id"`
+	Analyses int     `db:"analyses"`
+	CPUHours float64 `db:"cpu_hours"`
+}
+
+// TopConsumers returns the users, apps, or systems that used the most CPU hours between the start and end times, in
+// descending order. Only the part of each analysis step that ran during the time window is counted, using the step's
+// reservation (or the analysis's if the step doesn't have one), and steps that are still running are counted up to
+// the current time. If jobType isn't empty, only analyses of that job type are included.
+func (d *Database) TopConsumers(context context.Context, dimension ReportDimension, from, to time.Time, jobType string, limit int) ([]UsageRank, error) {
+	switch dimension {
+	case ReportByUser, ReportByApp, ReportBySystem:
+	default:
+		return nil, fmt.Errorf("unsupported report dimension %q", dimension)
+	}
+
+	// The dimension is one of the constants above, so it's safe to include in the query.
+	q := fmt.Sprintf(`
+		WITH step_usage AS (
+			SELECT
+				j.id analysis_id,
+				u.username,
+				j.app_id,
+				t.name job_type,
+				t.system_id,
+				COALESCE(s.millicores_reserved, j.millicores_reserved, 0)::numeric
+					* EXTRACT(EPOCH FROM (
+						LEAST(COALESCE(s.end_date::timestamptz, now()), $2::timestamptz)
+						- GREATEST(s.start_date::timestamptz, $1::timestamptz)
+					))
+					/ 3600 / 1000 cpu_hours
+			FROM jobs j
+			JOIN job_types t ON j.job_type_id = t.id
+			JOIN users u ON j.user_id = u.id
+			JOIN job_steps s ON s.job_id = j.id
+			WHERE s.start_date::timestamptz < $2::timestamptz
+			AND COALESCE(s.end_date::timestamptz, now()) > $1::timestamptz
+			AND ($3 = '' OR t.name = $3)
+		),
+		grouped AS (
+			SELECT
+				%[1]s name,
+				job_type,
+				system_id,
+				count(DISTINCT analysis_id) analyses,
+				sum(cpu_hours) cpu_hours
+			FROM step_usage
+			GROUP BY %[1]s, job_type, system_id
+		),
+		top AS (
+			SELECT name
+			FROM grouped
+			GROUP BY name
+			ORDER BY sum(cpu_hours) DESC, name
+			LIMIT $4
+		)
+		SELECT g.name, g.job_type, g.system_id, g.analyses, g.cpu_hours::double precision
+		FROM grouped g
+		JOIN top USING (name);
+	`, dimension)
+
+	rows, err := d.Q().QueryxContext(context, q, from, to, jobType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	ranks := make(map[string]*UsageRank)
+	for rows.Next() {
+		var b usageBreakdown
+		if err = rows.StructScan(&b); err != nil {
+			return nil, err
+		}
+
+		rank, ok := ranks[b.Name]
+		if !ok {
+			rank = &UsageRank{
+				Name:      b.Name,
+				ByJobType: make(map[string]float64),
+				BySystem:  make(map[string]float64),
+			}
+			ranks[b.Name] = rank
+		}
+
+		rank.Analyses += b.Analyses
+		rank.CPUHours += b.CPUHours
+		rank.ByJobType[b.JobType] += b.CPUHours
+		rank.BySystem[b.SystemID] += b.CPUHours
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]UsageRank, 0, len(ranks))
+	for _, rank := range ranks {
+		result = append(result, *rank)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CPUHours != result[j].CPUHours {
+			return result[i].CPUHours > result[j].CPUHours
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
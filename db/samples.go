@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReportByAnalysis groups usage by analysis ID. It's only supported by the efficiency report.
+const ReportByAnalysis ReportDimension = "analysis_id"
+
+// UsageSample is a measurement of the CPU an analysis was actually using at a point in time.
+type UsageSample struct {
+	AnalysisID     string    `db:"job_id" json:"analysis_id"`
+	SampledAt      time.Time `db:"sampled_at" json:"sampled_at"`
+	MillicoresUsed float64   `db:"millicores_used" json:"millicores_used"`
+}
+
+// ReservationEfficiency compares the CPU reserved for analyses to the CPU they actually used.
+type ReservationEfficiency struct {
+	Name               string  `db:"name" json:"name"`
+	Analyses           int     `db:"analyses" json:"analyses"`
+	Samples            int     `db:"samples" json:"samples"`
+	MillicoresReserved float64 `db:"millicores_reserved" json:"millicores_reserved"`
+	MillicoresUsed     float64 `db:"millicores_used" json:"millicores_used"`
+	Efficiency         float64 `db:"efficiency" json:"efficiency"`
+}
+
+// The most samples inserted by a single statement, which keeps the number of parameters well below the limit.
+const maxSamplesPerInsert = 1000
+
+// AddUsageSamples records CPU usage samples. A sample for an analysis at a time that's already been recorded
+// replaces the earlier one, so the same samples can be imported more than once. If the same analysis and time appear
+// more than once in the samples, the last one is kept.
+func (d *Database) AddUsageSamples(context context.Context, samples []UsageSample) error {
+	// A single insert can't update the same row twice, so only the last of each set of duplicates is kept.
+	type sampleKey struct {
+		analysisID string
+		sampledAt  int64
+	}
+	index := make(map[sampleKey]int, len(samples))
+	unique := make([]UsageSample, 0, len(samples))
+	for _, sample := range samples {
+		key := sampleKey{analysisID: sample.AnalysisID, sampledAt: sample.SampledAt.UnixMicro()}
+		if i, ok := index[key]; ok {
+			unique[i] = sample
+			continue
+		}
+		index[key] = len(unique)
+		unique = append(unique, sample)
+	}
+
+	for start := 0; start < len(unique); start += maxSamplesPerInsert {
+		end := min(start+maxSamplesPerInsert, len(unique))
+		batch := unique[start:end]
+
+		var q strings.Builder
+		q.WriteString("INSERT INTO cpu_usage_samples (job_id, sampled_at, millicores_used) VALUES ")
+
+		args := make([]interface{}, 0, len(batch)*3)
+		for i, sample := range batch {
+			if i > 0 {
+				q.WriteString(", ")
+			}
+			fmt.Fprintf(&q, "($%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3)
+			args = append(args, sample.AnalysisID, sample.SampledAt, sample.MillicoresUsed)
+		}
+		q.WriteString(" ON CONFLICT (job_id, sampled_at) DO UPDATE SET millicores_used = EXCLUDED.millicores_used")
+
+		if _, err := d.Q().ExecContext(context, q.String(), args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReservationEfficiency compares the CPU reserved for analyses to the average CPU they used, based on the samples
+// taken between the start and end times. Each sample is compared to the reservation of the analysis step that was
+// running when it was taken, or the analysis's reservation if the step doesn't have one. An analysis's reservation is
+// the average of the reservations its samples were compared to. Only analyses with samples are included. Each analysis is counted once
+// when grouping by app or user, so the averages for a group are the sums of the reservations and average usage of
+// its analyses divided by the number of analyses. The least efficient are listed first.
+func (d *Database) ReservationEfficiency(context context.Context, dimension ReportDimension, from, to time.Time, limit int) ([]ReservationEfficiency, error) {
+	switch dimension {
+	case ReportByAnalysis, ReportByUser, ReportByApp:
+	default:
+		return nil, fmt.Errorf("unsupported report dimension %q", dimension)
+	}
+
+	// The dimension is one of the constants above, so it's safe to include in the query.
+	q := fmt.Sprintf(`
+		WITH analyses AS (
+			SELECT
+				j.id analysis_id,
+				u.username,
+				j.app_id,
+				avg(COALESCE(st.millicores_reserved, j.millicores_reserved, 0))::numeric millicores_reserved,
+				avg(s.millicores_used) millicores_used,
+				count(*) samples
+			FROM cpu_usage_samples s
+			JOIN jobs j ON s.job_id = j.id
+			JOIN users u ON j.user_id = u.id
+			LEFT JOIN LATERAL (
+				SELECT js.millicores_reserved
+				FROM job_steps js
+				WHERE js.job_id = j.id
+				AND js.start_date::timestamptz <= s.sampled_at
+				ORDER BY js.start_date DESC, js.step_number DESC
+				LIMIT 1
+			) st ON true
+			WHERE s.sampled_at >= $1
+			AND s.sampled_at < $2
+			GROUP BY j.id, u.username, j.app_id
+		)
+		SELECT
+			%[1]s::text name,
+			count(*) analyses,
+			sum(samples) samples,
+			avg(millicores_reserved)::double precision millicores_reserved,
+			avg(millicores_used)::double precision millicores_used,
+			COALESCE(sum(millicores_used) / NULLIF(sum(millicores_reserved), 0), 0)::double precision efficiency
+		FROM analyses
+		GROUP BY %[1]s
+		ORDER BY efficiency, name
+		LIMIT $3;
+	`, dimension)
+
+	rows, err := d.Q().QueryxContext(context, q, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	result := []ReservationEfficiency{}
+	for rows.Next() {
+		var e ReservationEfficiency
+		if err = rows.StructScan(&e); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// execDriver is a database/sql driver that records the statements executed on it.
+type execDriver struct {
+	mu    sync.Mutex
+	execs []execCall
+}
+
+type execCall struct {
+	query string
+	args  []driver.NamedValue
+}
+
+func (d *execDriver) Open(_ string) (driver.Conn, error) { return &execConn{driver: d}, nil }
+
+type execConn struct{ driver *execDriver }
+
+func (c *execConn) Prepare(_ string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *execConn) Close() error                          { return nil }
+func (c *execConn) Begin() (driver.Tx, error)             { return nil, errors.New("not supported") }
+
+func (c *execConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.execs = append(c.driver.execs, execCall{query: query, args: args})
+	return driver.RowsAffected(len(args) / 3), nil
+}
+
+type execConnector struct{ driver *execDriver }
+
+func (c execConnector) Connect(_ context.Context) (driver.Conn, error) { return c.driver.Open("") }
+func (c execConnector) Driver() driver.Driver                          { return c.driver }
+
+func TestAddUsageSamples(t *testing.T) {
+	d := &execDriver{}
+	database := New(sqlx.NewDb(sql.OpenDB(execConnector{driver: d}), "test"))
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var samples []UsageSample
+	for i := 0; i < maxSamplesPerInsert+10; i++ {
+		samples = append(samples, UsageSample{
+			AnalysisID:     fmt.Sprintf("analysis-%d", i%2),
+			SampledAt:      start.Add(time.Duration(i) * time.Minute),
+			MillicoresUsed: float64(i),
+		})
+	}
+
+	// A later sample for the same analysis and time replaces the earlier one.
+	samples = append(samples, UsageSample{AnalysisID: "analysis-0", SampledAt: start, MillicoresUsed: 5000})
+
+	if err := database.AddUsageSamples(context.Background(), samples); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(d.execs) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(d.execs))
+	}
+
+	var rows int
+	for _, exec := range d.execs {
+		if !strings.HasPrefix(exec.query, "INSERT INTO cpu_usage_samples") || strings.Count(exec.query, "), (") != len(exec.args)/3-1 {
+			t.Errorf("unexpected statement with %d arguments: %.120s", len(exec.args), exec.query)
+		}
+		rows += len(exec.args) / 3
+	}
+	if rows != maxSamplesPerInsert+10 {
+		t.Errorf("expected %d samples to be inserted, got %d", maxSamplesPerInsert+10, rows)
+	}
+
+	first := d.execs[0].args
+	if first[0].Value != "analysis-0" || first[2].Value != float64(5000) {
+		t.Errorf("expected the duplicate sample to replace the first one, got %v, %v", first[0].Value, first[2].Value)
+	}
+}
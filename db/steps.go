@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// AnalysisStep contains the information needed to account for the usage of a single step of an analysis.
+type AnalysisStep struct {
+	JobID              string    `db:"job_id" json:"job_id"`
+	StepNumber         int       `db:"step_number" json:"step_number"`
+	ExternalID         string    `db:"external_id" json:"external_id"`
+	StartDate          null.Time `db:"start_date" json:"start_date"`
+	EndDate            null.Time `db:"end_date" json:"end_date"`
+	Status             string    `db:"status" json:"status"`
+	UsageLastUpdate    null.Time `db:"usage_last_update" json:"usage_last_update"`
+	MillicoresReserved int64     `db:"millicores_reserved" json:"millicores_reserved"`
+}
+
+// StepByExternalID returns the analysis step with the given external ID and locks its row. Steps without their own
+// reservation use the reservation of the analysis.
+func (d *Database) StepByExternalID(context context.Context, externalID string) (*AnalysisStep, error) {
+	const q = `
+		SELECT
+			s.job_id,
+			s.step_number,
+			s.external_id,
+			s.start_date::timestamptz start_date,
+			s.end_date::timestamptz end_date,
+			s.status,
+			s.usage_last_update,
+			COALESCE(s.millicores_reserved, j.millicores_reserved, 0) millicores_reserved
+		FROM job_steps s
+		JOIN jobs j ON s.job_id = j.id
+		WHERE s.external_id = $1
+		FOR NO KEY UPDATE OF s;
+	`
+	var step AnalysisStep
+	err := d.Q().QueryRowxContext(context, q, externalID).StructScan(&step)
+	if err != nil {
+		return nil, err
+	}
+	return &step, nil
+}
+
+// SetStepUsageLastUpdate updates the `usage_last_update` column of the job_steps table to the provided time.
+func (d *Database) SetStepUsageLastUpdate(context context.Context, externalID string, usagetime time.Time) error {
+	const q = `
+		UPDATE job_steps
+		SET usage_last_update = $2
+		WHERE external_id = $1
+	`
+	_, err := d.Q().ExecContext(context, q, externalID, usagetime)
+	return err
+}
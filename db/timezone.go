@@ -0,0 +1,22 @@
+package db
+
+import "context"
+
+// SessionTimeZone returns the session time zone, which is the time zone used for the DE database's timestamps
+// without time zones.
+//
+// Most of the timestamps in the DE's tables don't have time zones. This service always works with instants, so
+// queries cast those columns to timestamp with time zone when reading them and pass timestamps with time zones when
+// writing them. The database converts between the two using the session time zone, which is set to the configured
+// time zone when connecting, or left as the server's TimeZone setting if one isn't configured. That keeps the results
+// independent of the time zone the service runs in and correct across daylight saving time changes. The columns that
+// this service owns have time zones.
+func (d *Database) SessionTimeZone(context context.Context) (string, error) {
+	const q = `SHOW TimeZone`
+
+	var timeZone string
+	if err := d.Q().QueryRowxContext(context, q).Scan(&timeZone); err != nil {
+		return "", err
+	}
+	return timeZone, nil
+}
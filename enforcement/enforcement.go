@@ -0,0 +1,293 @@
+package enforcement
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/guregu/null"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "enforcement"})
+
+// The HTTP client used to send over-quota events to an endpoint.
+var httpClient = http.Client{Transport: http.DefaultTransport, Timeout: 30 * time.Second}
+
+// OverQuotaEventVersion is the version of the OverQuotaEvent message format.
+const OverQuotaEventVersion = 1
+
+// OverQuotaEvent is sent when a user's usage of a resource type has exceeded their quota for longer than the grace
+// period. It identifies the user's running analyses so that the platform can warn the user or stop the analyses.
+type OverQuotaEvent struct {
+	Version         int                  `json:"version"`
+	Username        string               `json:"username"`
+	UserID          string               `json:"user_id"`
+	SubscriptionID  string               `json:"subscription_id"`
+	PlanName        string               `json:"plan_name"`
+	ResourceType    string               `json:"resource_type"`
+	Quota           float64              `json:"quota"`
+	Usage           float64              `json:"usage"`
+	FirstExceededAt time.Time            `json:"first_exceeded_at"`
+	GracePeriodEnd  time.Time            `json:"grace_period_end"`
+	Analyses        []db.RunningAnalysis `json:"analyses"`
+	SentAt          time.Time            `json:"sent_at"`
+}
+
+// Signaller delivers over-quota events to whatever is responsible for acting on them.
+type Signaller interface {
+	Signal(context context.Context, event *OverQuotaEvent) error
+}
+
+// JSONPublisher publishes JSON messages over AMQP.
+type JSONPublisher interface {
+	PublishJSON(context context.Context, key string, v interface{}) error
+}
+
+// AMQPSignaller publishes over-quota events on an AMQP routing key.
+type AMQPSignaller struct {
+	Publisher  JSONPublisher
+	RoutingKey string
+}
+
+// Signal publishes the event.
+func (s *AMQPSignaller) Signal(context context.Context, event *OverQuotaEvent) error {
+	return s.Publisher.PublishJSON(context, s.RoutingKey, event)
+}
+
+// HTTPSignaller POSTs over-quota events to an HTTP endpoint.
+type HTTPSignaller struct {
+	URL string
+}
+
+// Signal sends the event to the endpoint.
+func (s *HTTPSignaller) Signal(context context.Context, event *OverQuotaEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal the over-quota event")
+	}
+
+	req, err := http.NewRequestWithContext(context, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "unable to build the request for %s", s.URL)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "unable to send the request to %s", s.URL)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return clients.NewHTTPError(resp.StatusCode, fmt.Sprintf("%s returned %d", s.URL, resp.StatusCode))
+	}
+
+	return nil
+}
+
+// Store records the users whose usage is over quota and looks up their running analyses.
+type Store interface {
+	RunningAnalyses(context context.Context, userID string) ([]db.RunningAnalysis, error)
+	RecordQuotaOverage(context context.Context, subscriptionID, resourceType, username, userID string) (*db.QuotaOverage, error)
+	ExpiredQuotaOverages(context context.Context, gracePeriod time.Duration) ([]db.QuotaOverage, error)
+	ClearQuotaOverage(context context.Context, subscriptionID, resourceType string) error
+	MarkQuotaOverageSignalled(context context.Context, subscriptionID, resourceType string, previous, signalledAt null.Time) (bool, error)
+}
+
+// SubscriptionLookup looks up users' current subscriptions.
+type SubscriptionLookup interface {
+	GetUserSubscription(context context.Context, username string) (*qms.Subscription, error)
+}
+
+// Enforcer checks whether a user's usage has exceeded their quota after usage is recorded, signalling the user's
+// running analyses once the overage has lasted longer than the grace period. Each running analysis is only signalled
+// once per subscription period.
+type Enforcer struct {
+	store         Store
+	subscriptions SubscriptionLookup
+	signaller     Signaller
+	gracePeriod   time.Duration
+	exemptPlans   map[string]bool
+}
+
+// New returns a new *Enforcer. Users subscribed to one of the exempt plans are never signalled.
+func New(store Store, subscriptions SubscriptionLookup, signaller Signaller, gracePeriod time.Duration, exemptPlans []string) *Enforcer {
+	exempt := make(map[string]bool)
+	for _, plan := range exemptPlans {
+		exempt[plan] = true
+	}
+
+	return &Enforcer{
+		store:         store,
+		subscriptions: subscriptions,
+		signaller:     signaller,
+		gracePeriod:   gracePeriod,
+		exemptPlans:   exempt,
+	}
+}
+
+// Check compares the user's usage of the resource type to their quota and signals their running analyses if the
+// usage has been over quota for longer than the grace period.
+func (e *Enforcer) Check(context context.Context, username, userID, resourceType string) error {
+	subscription, err := e.subscriptions.GetUserSubscription(context, username)
+	if err != nil {
+		return err
+	}
+	return e.enforce(context, subscription, username, userID, resourceType)
+}
+
+// Run sweeps the recorded overages every interval until the context is cancelled.
+func (e *Enforcer) Run(context context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+			if err := e.Sweep(context); err != nil {
+				log.WithContext(context).WithError(err).Error("unable to sweep quota overages")
+			}
+		}
+	}
+}
+
+// Sweep checks the users whose overages have outlasted the grace period again. Check only runs when usage is
+// recorded, so without the sweep a user whose grace period ends while their analyses are still running wouldn't be
+// signalled until one of their steps is charged. Overages from earlier subscription periods are removed.
+func (e *Enforcer) Sweep(context context.Context) error {
+	overages, err := e.store.ExpiredQuotaOverages(context, e.gracePeriod)
+	if err != nil {
+		return err
+	}
+
+	for _, overage := range overages {
+		msgLog := log.WithFields(logrus.Fields{"context": "sweeping quota overages", "user": overage.Username}).WithContext(context)
+
+		subscription, err := e.subscriptions.GetUserSubscription(context, overage.Username)
+		if err != nil {
+			msgLog.WithError(err).Error("unable to look up the subscription")
+			continue
+		}
+
+		if subscription.GetUuid() != overage.SubscriptionID {
+			msgLog.Debugf("subscription %s has ended, removing its overage", overage.SubscriptionID)
+			if err = e.store.ClearQuotaOverage(context, overage.SubscriptionID, overage.ResourceType); err != nil {
+				msgLog.WithError(err).Error("unable to remove the overage")
+				continue
+			}
+		}
+
+		if err = e.enforce(context, subscription, overage.Username, overage.UserID, overage.ResourceType); err != nil {
+			msgLog.WithError(err).Error("unable to enforce the quota")
+		}
+	}
+
+	return nil
+}
+
+// enforce compares the user's usage of the resource type in the subscription to the quota and signals their running
+// analyses once the grace period has ended.
+func (e *Enforcer) enforce(context context.Context, subscription *qms.Subscription, username, userID, resourceType string) error {
+	msgLog := log.WithFields(logrus.Fields{"context": "enforcing quota", "user": username}).WithContext(context)
+
+	planName := subscription.GetPlan().GetName()
+	if e.exemptPlans[planName] {
+		msgLog.Debugf("the %s plan is exempt from quota enforcement", planName)
+		return nil
+	}
+
+	quota, usage, found := clients.QuotaAndUsage(subscription, resourceType)
+	if !found {
+		msgLog.Debugf("no %s quota found, skipping enforcement", resourceType)
+		return nil
+	}
+
+	if usage <= quota {
+		return e.store.ClearQuotaOverage(context, subscription.GetUuid(), resourceType)
+	}
+
+	overage, err := e.store.RecordQuotaOverage(context, subscription.GetUuid(), resourceType, username, userID)
+	if err != nil {
+		return err
+	}
+
+	graceEnd := overage.FirstExceededAt.Add(e.gracePeriod)
+	if time.Now().Before(graceEnd) {
+		msgLog.Infof("%s usage of %f exceeds the quota of %f; grace period ends at %s", resourceType, usage, quota, graceEnd)
+		return nil
+	}
+
+	analyses, err := e.store.RunningAnalyses(context, userID)
+	if err != nil {
+		return err
+	}
+
+	// The analyses that were running when the overage was last signalled have already been dealt with.
+	if overage.SignalledAt.Valid {
+		analyses = startedAfter(analyses, overage.SignalledAt.Time)
+	}
+
+	if len(analyses) == 0 {
+		msgLog.Debug("over quota, but there are no running analyses to signal")
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	marked, err := e.store.MarkQuotaOverageSignalled(context, subscription.GetUuid(), resourceType, overage.SignalledAt, null.TimeFrom(now))
+	if err != nil {
+		return err
+	}
+	if !marked {
+		msgLog.Debug("the overage was signalled by another instance")
+		return nil
+	}
+
+	event := &OverQuotaEvent{
+		Version:         OverQuotaEventVersion,
+		Username:        clients.StripUsernameSuffix(username),
+		UserID:          userID,
+		SubscriptionID:  subscription.GetUuid(),
+		PlanName:        planName,
+		ResourceType:    resourceType,
+		Quota:           quota,
+		Usage:           usage,
+		FirstExceededAt: overage.FirstExceededAt.UTC(),
+		GracePeriodEnd:  graceEnd.UTC(),
+		Analyses:        analyses,
+		SentAt:          now.UTC(),
+	}
+
+	msgLog.Infof("signalling %d running analyses for exceeding the %s quota", len(analyses), resourceType)
+	if err = e.signaller.Signal(context, event); err != nil {
+		// Restore the previous signal time so that the analyses are signalled again on the next check.
+		_, restoreErr := e.store.MarkQuotaOverageSignalled(context, subscription.GetUuid(), resourceType, null.TimeFrom(now), overage.SignalledAt)
+		if restoreErr != nil {
+			msgLog.WithError(restoreErr).Error("unable to restore the overage signal time")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// startedAfter returns the analyses that started after the given time.
+func startedAfter(analyses []db.RunningAnalysis, t time.Time) []db.RunningAnalysis {
+	var started []db.RunningAnalysis
+	for _, analysis := range analyses {
+		if analysis.StartDate.After(t) {
+			started = append(started, analysis)
+		}
+	}
+	return started
+}
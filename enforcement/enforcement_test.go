@@ -0,0 +1,220 @@
+package enforcement_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/enforcement"
+	"github.com/cyverse-de/resource-usage-api/fakes"
+)
+
+const (
+	userID         = "user-1"
+	username       = "ipcdev@iplantcollaborative.org"
+	subscriptionID = "subscription-1"
+	resourceType   = "cpu.hours"
+	gracePeriod    = time.Hour
+)
+
+var overageKey = fakes.OverageKey{SubscriptionID: subscriptionID, ResourceType: resourceType}
+
+// signaller records the events that are signalled, failing instead when err is set.
+type signaller struct {
+	err    error
+	events []*enforcement.OverQuotaEvent
+}
+
+func (s *signaller) Signal(_ context.Context, event *enforcement.OverQuotaEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// setup returns an enforcer for a user on the given plan with a quota of 20 CPU hours, of which they've used the
+// given amount, and who has a single running analysis.
+func setup(plan string, usage float64) (*fakes.QuotaStore, *fakes.QMS, *signaller, *enforcement.Enforcer) {
+	cpuHours := &qms.ResourceType{Name: resourceType, Unit: "cpu hours"}
+
+	qmsClient := fakes.NewQMS()
+	qmsClient.Subscriptions["ipcdev"] = &qms.Subscription{
+		Uuid:   subscriptionID,
+		Plan:   &qms.Plan{Name: plan},
+		Quotas: []*qms.Quota{{ResourceType: cpuHours, Quota: 20}},
+		Usages: []*qms.Usage{{ResourceType: cpuHours, Usage: usage}},
+	}
+
+	store := fakes.NewQuotaStore()
+	store.Analyses[userID] = []db.RunningAnalysis{
+		{ID: "analysis-1", StartDate: time.Now().Add(-2 * time.Hour)},
+	}
+
+	sig := &signaller{}
+	return store, qmsClient, sig, enforcement.New(store, qmsClient, sig, gracePeriod, []string{"Unlimited"})
+}
+
+// expireGracePeriod moves the start of the overage back so that its grace period has ended.
+func expireGracePeriod(store *fakes.QuotaStore) {
+	store.Overages[overageKey].FirstExceededAt = time.Now().Add(-2 * gracePeriod)
+}
+
+func TestCheckGracePeriod(t *testing.T) {
+	store, _, sig, enforcer := setup("Basic", 21.5)
+	context := context.Background()
+
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sig.events) != 0 {
+		t.Fatalf("expected no events during the grace period, got %d", len(sig.events))
+	}
+	if _, ok := store.Overages[overageKey]; !ok {
+		t.Fatal("expected the overage to be recorded")
+	}
+
+	expireGracePeriod(store)
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sig.events) != 1 {
+		t.Fatalf("expected an event once the grace period ended, got %d", len(sig.events))
+	}
+
+	event := sig.events[0]
+	if event.Username != "ipcdev" || event.UserID != userID || event.SubscriptionID != subscriptionID ||
+		event.Quota != 20 || event.Usage != 21.5 || len(event.Analyses) != 1 || event.Analyses[0].ID != "analysis-1" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if !event.GracePeriodEnd.Equal(event.FirstExceededAt.Add(gracePeriod)) {
+		t.Errorf("expected the grace period to end %s after %s, got %s", gracePeriod, event.FirstExceededAt, event.GracePeriodEnd)
+	}
+}
+
+func TestCheckUnderQuotaClearsOverage(t *testing.T) {
+	store, qmsClient, sig, enforcer := setup("Basic", 21.5)
+	context := context.Background()
+
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	qmsClient.Subscriptions["ipcdev"].Quotas[0].Quota = 50
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(store.Overages) != 0 {
+		t.Errorf("expected the overage to be cleared, got %+v", store.Overages)
+	}
+	if len(sig.events) != 0 {
+		t.Errorf("expected no events, got %d", len(sig.events))
+	}
+}
+
+func TestCheckExemptPlan(t *testing.T) {
+	store, _, sig, enforcer := setup("Unlimited", 21.5)
+
+	if err := enforcer.Check(context.Background(), username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(store.Overages) != 0 {
+		t.Errorf("expected no overage to be recorded for an exempt plan, got %+v", store.Overages)
+	}
+	if len(sig.events) != 0 {
+		t.Errorf("expected no events for an exempt plan, got %d", len(sig.events))
+	}
+}
+
+func TestSignalsAreDeduplicated(t *testing.T) {
+	store, _, sig, enforcer := setup("Basic", 21.5)
+	context := context.Background()
+
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expireGracePeriod(store)
+
+	for i := 0; i < 3; i++ {
+		if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := enforcer.Sweep(context); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(sig.events) != 1 {
+		t.Fatalf("expected the running analysis to be signalled once, got %d events", len(sig.events))
+	}
+
+	// An analysis started after the signal is signalled on its own.
+	store.Analyses[userID] = append(store.Analyses[userID], db.RunningAnalysis{ID: "analysis-2", StartDate: time.Now()})
+	for i := 0; i < 2; i++ {
+		if err := enforcer.Sweep(context); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(sig.events) != 2 {
+		t.Fatalf("expected the new analysis to be signalled once, got %d events", len(sig.events))
+	}
+	if analyses := sig.events[1].Analyses; len(analyses) != 1 || analyses[0].ID != "analysis-2" {
+		t.Errorf("expected only the new analysis to be signalled, got %+v", analyses)
+	}
+}
+
+func TestFailedSignalIsRetried(t *testing.T) {
+	store, _, sig, enforcer := setup("Basic", 21.5)
+	context := context.Background()
+
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expireGracePeriod(store)
+
+	sig.err = errors.New("broker unavailable")
+	if err := enforcer.Check(context, username, userID, resourceType); err == nil {
+		t.Fatal("expected the signal error to be returned")
+	}
+	if store.Overages[overageKey].SignalledAt.Valid {
+		t.Error("expected the failed signal not to be recorded")
+	}
+
+	sig.err = nil
+	if err := enforcer.Sweep(context); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sig.events) != 1 {
+		t.Errorf("expected the signal to be retried, got %d events", len(sig.events))
+	}
+}
+
+func TestSweepRemovesEndedSubscriptions(t *testing.T) {
+	store, qmsClient, sig, enforcer := setup("Basic", 21.5)
+	context := context.Background()
+
+	if err := enforcer.Check(context, username, userID, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expireGracePeriod(store)
+
+	// The new subscription's overage starts a new grace period.
+	qmsClient.Subscriptions["ipcdev"].Uuid = "subscription-2"
+	if err := enforcer.Sweep(context); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, ok := store.Overages[overageKey]; ok {
+		t.Error("expected the ended subscription's overage to be removed")
+	}
+	if _, ok := store.Overages[fakes.OverageKey{SubscriptionID: "subscription-2", ResourceType: resourceType}]; !ok {
+		t.Error("expected an overage to be recorded for the new subscription")
+	}
+	if len(sig.events) != 0 {
+		t.Errorf("expected no events during the new grace period, got %d", len(sig.events))
+	}
+}
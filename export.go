@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/export"
+)
+
+// parseDate parses a date or an RFC 3339 timestamp.
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runExport runs the export subcommand, which writes usage records for a date range to a file or to standard output.
+func runExport(ctx context.Context, args []string, database *db.Database) error {
+	var (
+		kindName, formatName, fromValue, toValue, output string
+	)
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&kindName, "kind", string(export.KindUsers), "The kind of records to export: users or analyses")
+	flags.StringVar(&formatName, "format", string(export.FormatCSV), "The output format: csv or jsonl")
+	flags.StringVar(&fromValue, "from", "", "The start of the date range, as a date or an RFC 3339 timestamp")
+	flags.StringVar(&toValue, "to", "", "The end of the date range, which is not included, as a date or an RFC 3339 timestamp")
+	flags.StringVar(&output, "output", "", "The file to write to. Defaults to standard output")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	kind, err := export.ParseKind(kindName)
+	if err != nil {
+		return err
+	}
+	format, err := export.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+
+	if fromValue == "" || toValue == "" {
+		return errors.New("--from and --to are required")
+	}
+	from, err := parseDate(fromValue)
+	if err != nil {
+		return err
+	}
+	to, err := parseDate(toValue)
+	if err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return errors.New("--from must be before --to")
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close() // nolint: errcheck
+		out = f
+	}
+
+	return export.Export(ctx, database, kind, format, from, to, out)
+}
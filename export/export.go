@@ -0,0 +1,263 @@
+// Package export writes usage records in formats that can be loaded into spreadsheets and other tools.
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+)
+
+// Format is an export file format.
+type Format string
+
+const (
+	// FormatCSV writes a header row followed by one row per record.
+	FormatCSV Format = "csv"
+
+	// FormatJSONL writes one JSON object per line.
+	FormatJSONL Format = "jsonl"
+)
+
+// ContentType returns the MIME type for the format.
+func (f Format) ContentType() string {
+	if f == FormatJSONL {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// Kind is the kind of record being exported.
+type Kind string
+
+const (
+	// KindAnalyses exports one record per analysis.
+	KindAnalyses Kind = "analyses"
+
+	// KindUsers exports one record per user.
+	KindUsers Kind = "users"
+)
+
+// The number of records written between flushes, so that large exports are sent to HTTP clients as they're written.
+const flushInterval = 100
+
+// Columns are the names of the fields in each kind of record, in order. They're used as the CSV header and as the
+// JSON keys, and shouldn't be changed or reordered once published; new columns go at the end.
+var Columns = map[Kind][]string{
+	KindAnalyses: {
+		"analysis_id",
+		"analysis_name",
+		"username",
+		"user_id",
+		"app_id",
+		"job_type",
+		"system_id",
+		"start_date",
+		"end_date",
+		"steps",
+		"cpu_hours",
+	},
+	KindUsers: {
+		"username",
+		"user_id",
+		"analyses",
+		"calculated_cpu_hours",
+		"added_cpu_hours",
+		"subtracted_cpu_hours",
+		"resets",
+	},
+}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case FormatCSV, FormatJSONL:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unsupported export format %q; must be csv or jsonl", name)
+}
+
+// ParseKind returns the kind of record with the given name.
+func ParseKind(name string) (Kind, error) {
+	kind := Kind(name)
+	if _, ok := Columns[kind]; !ok {
+		return "", fmt.Errorf("unsupported export kind %q; must be analyses or users", name)
+	}
+	return kind, nil
+}
+
+func formatTime(t null.Time) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.UTC().Format(time.RFC3339)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func analysisValues(r *db.AnalysisUsageRecord) []string {
+	return []string{
+		r.AnalysisID,
+		r.AnalysisName,
+		clients.StripUsernameSuffix(r.Username),
+		r.UserID,
+		r.AppID,
+		r.JobType,
+		r.SystemID,
+		formatTime(r.StartDate),
+		formatTime(r.EndDate),
+		strconv.Itoa(r.Steps),
+		formatFloat(r.CPUHours),
+	}
+}
+
+func userValues(r *db.UserUsageRecord) []string {
+	return []string{
+		clients.StripUsernameSuffix(r.Username),
+		r.UserID,
+		strconv.Itoa(r.Analyses),
+		formatFloat(r.CalculatedCPUHours),
+		formatFloat(r.AddedCPUHours),
+		formatFloat(r.SubtractedCPUHours),
+		strconv.Itoa(r.Resets),
+	}
+}
+
+// flusher is implemented by writers that buffer output, such as HTTP responses.
+type flusher interface {
+	Flush()
+}
+
+// recordWriter writes records with a fixed set of columns.
+type recordWriter struct {
+	out     io.Writer
+	format  Format
+	columns []string
+	csv     *csv.Writer
+	count   int
+}
+
+func newRecordWriter(out io.Writer, format Format, columns []string) (*recordWriter, error) {
+	w := &recordWriter{out: out, format: format, columns: columns}
+	if format == FormatCSV {
+		w.csv = csv.NewWriter(out)
+		if err := w.csv.Write(columns); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// write writes a record, given as values in the same order as the columns.
+func (w *recordWriter) write(values []string) error {
+	var err error
+
+	if w.format == FormatCSV {
+		err = w.csv.Write(values)
+	} else {
+		err = w.writeJSON(values)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.count++
+	if w.count%flushInterval == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+// writeJSON writes a record as a JSON object, keeping the keys in column order. Numeric columns are written as
+// numbers so that consumers don't have to convert them.
+func (w *recordWriter) writeJSON(values []string) error {
+	buf := []byte{'{'}
+	for i, column := range w.columns {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+
+		if numericColumns[column] {
+			buf = append(buf, values[i]...)
+			continue
+		}
+
+		value, err := json.Marshal(values[i])
+		if err != nil {
+			return err
+		}
+		buf = append(buf, value...)
+	}
+	buf = append(buf, '}', '\n')
+
+	_, err := w.out.Write(buf)
+	return err
+}
+
+// flush writes any buffered output.
+func (w *recordWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.out.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// numericColumns are the columns that are written as numbers in JSON.
+var numericColumns = map[string]bool{
+	"steps":                true,
+	"cpu_hours":            true,
+	"analyses":             true,
+	"calculated_cpu_hours": true,
+	"added_cpu_hours":      true,
+	"subtracted_cpu_hours": true,
+	"resets":               true,
+}
+
+// Export writes the records of the given kind for usage recorded from the start time up to, but not including, the
+// end time. Records are written as they're read from the database.
+func Export(context context.Context, database *db.Database, kind Kind, format Format, from, to time.Time, out io.Writer) error {
+	w, err := newRecordWriter(out, format, Columns[kind])
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case KindAnalyses:
+		err = database.StreamAnalysisUsage(context, from, to, func(r *db.AnalysisUsageRecord) error {
+			return w.write(analysisValues(r))
+		})
+	case KindUsers:
+		err = database.StreamUserUsage(context, from, to, func(r *db.UserUsageRecord) error {
+			return w.write(userValues(r))
+		})
+	default:
+		err = fmt.Errorf("unsupported export kind %q", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.flush()
+}
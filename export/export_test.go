@@ -0,0 +1,85 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+)
+
+var testRecord = &db.AnalysisUsageRecord{
+	AnalysisID:   "b4d2a1a4-5c47-4a7e-9a3e-0d1f8e3f6a21",
+	AnalysisName: "word count, again",
+	Username:     "ipcdev@iplantcollaborative.org",
+	UserID:       "6b6d0b34-0c59-11ec-9a03-0242ac130003",
+	AppID:        "1b7a1f5e-1d4d-4b6e-b9c2-4c3f7f0f0e11",
+	JobType:      "Interactive",
+	SystemID:     "de",
+	StartDate:    null.TimeFrom(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+	Steps:        1,
+	CPUHours:     1.25,
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := newRecordWriter(&buf, FormatCSV, Columns[KindAnalyses])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.write(analysisValues(testRecord)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"analysis_id,analysis_name,username,user_id,app_id,job_type,system_id,start_date,end_date,steps,cpu_hours",
+		`b4d2a1a4-5c47-4a7e-9a3e-0d1f8e3f6a21,"word count, again",ipcdev,6b6d0b34-0c59-11ec-9a03-0242ac130003,` +
+			`1b7a1f5e-1d4d-4b6e-b9c2-4c3f7f0f0e11,Interactive,de,2024-03-01T12:00:00Z,,1,1.25`,
+		"",
+	}, "\n")
+
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := newRecordWriter(&buf, FormatJSONL, Columns[KindAnalyses])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = w.write(analysisValues(testRecord)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+
+	if !strings.HasPrefix(lines[0], `{"analysis_id":"b4d2a1a4-5c47-4a7e-9a3e-0d1f8e3f6a21","analysis_name":"word count, again",`) {
+		t.Errorf("the keys aren't in column order: %s", lines[0])
+	}
+
+	var decoded map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	if decoded["cpu_hours"] != 1.25 || decoded["steps"] != 1.0 {
+		t.Errorf("numeric columns weren't written as numbers: %s", lines[0])
+	}
+	if decoded["end_date"] != "" || decoded["username"] != "ipcdev" {
+		t.Errorf("unexpected values: %s", lines[0])
+	}
+}
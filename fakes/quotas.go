@@ -0,0 +1,147 @@
+package fakes
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/enforcement"
+	"github.com/cyverse-de/resource-usage-api/notifications"
+	"github.com/guregu/null"
+)
+
+var (
+	_ notifications.NotificationStore = (*QuotaStore)(nil)
+	_ enforcement.Store               = (*QuotaStore)(nil)
+)
+
+// QuotaNotification identifies a threshold notification that was sent for a subscription period.
+type QuotaNotification struct {
+	SubscriptionID string
+	ResourceType   string
+	Threshold      float64
+}
+
+// OverageKey identifies the overage of a resource type during a subscription period.
+type OverageKey struct {
+	SubscriptionID string
+	ResourceType   string
+}
+
+// QuotaStore is an in-memory store for the records kept about users' quotas. Like Store, its exported fields can be
+// used to set up and inspect its contents, but shouldn't be changed while it's in use.
+type QuotaStore struct {
+	// Notifications contains the threshold notifications that have been recorded as sent.
+	Notifications map[QuotaNotification]bool
+
+	// Overages contains the recorded quota overages.
+	Overages map[OverageKey]*db.QuotaOverage
+
+	// Analyses contains the running analyses, keyed by user ID.
+	Analyses map[string][]db.RunningAnalysis
+
+	mu sync.Mutex
+}
+
+// NewQuotaStore returns an empty *QuotaStore.
+func NewQuotaStore() *QuotaStore {
+	return &QuotaStore{
+		Notifications: make(map[QuotaNotification]bool),
+		Overages:      make(map[OverageKey]*db.QuotaOverage),
+		Analyses:      make(map[string][]db.RunningAnalysis),
+	}
+}
+
+// RecordQuotaNotification records that a threshold notification was sent, returning false if it already had been.
+func (s *QuotaStore) RecordQuotaNotification(_ context.Context, subscriptionID, resourceType string, threshold float64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := QuotaNotification{SubscriptionID: subscriptionID, ResourceType: resourceType, Threshold: threshold}
+	if s.Notifications[key] {
+		return false, nil
+	}
+	s.Notifications[key] = true
+	return true, nil
+}
+
+// DeleteQuotaNotification forgets that a threshold notification was sent.
+func (s *QuotaStore) DeleteQuotaNotification(_ context.Context, subscriptionID, resourceType string, threshold float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Notifications, QuotaNotification{SubscriptionID: subscriptionID, ResourceType: resourceType, Threshold: threshold})
+	return nil
+}
+
+// RunningAnalyses returns the user's running analyses.
+func (s *QuotaStore) RunningAnalyses(_ context.Context, userID string) ([]db.RunningAnalysis, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]db.RunningAnalysis(nil), s.Analyses[userID]...), nil
+}
+
+// RecordQuotaOverage records an overage, keeping the first recorded time if it had already been recorded.
+func (s *QuotaStore) RecordQuotaOverage(_ context.Context, subscriptionID, resourceType, username, userID string) (*db.QuotaOverage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := OverageKey{SubscriptionID: subscriptionID, ResourceType: resourceType}
+	overage, ok := s.Overages[key]
+	if !ok {
+		overage = &db.QuotaOverage{
+			SubscriptionID:  subscriptionID,
+			ResourceType:    resourceType,
+			FirstExceededAt: time.Now().Truncate(time.Microsecond),
+		}
+		s.Overages[key] = overage
+	}
+	overage.Username = username
+	overage.UserID = userID
+
+	recorded := *overage
+	return &recorded, nil
+}
+
+// ExpiredQuotaOverages returns the overages whose grace period has ended, oldest first.
+func (s *QuotaStore) ExpiredQuotaOverages(_ context.Context, gracePeriod time.Duration) ([]db.QuotaOverage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-gracePeriod)
+	overages := make([]db.QuotaOverage, 0)
+	for _, overage := range s.Overages {
+		if !overage.FirstExceededAt.After(cutoff) {
+			overages = append(overages, *overage)
+		}
+	}
+	sort.Slice(overages, func(i, j int) bool {
+		return overages[i].FirstExceededAt.Before(overages[j].FirstExceededAt)
+	})
+
+	return overages, nil
+}
+
+// ClearQuotaOverage removes an overage.
+func (s *QuotaStore) ClearQuotaOverage(_ context.Context, subscriptionID, resourceType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Overages, OverageKey{SubscriptionID: subscriptionID, ResourceType: resourceType})
+	return nil
+}
+
+// MarkQuotaOverageSignalled records when an overage was signalled if its signal time is still the previous one.
+func (s *QuotaStore) MarkQuotaOverageSignalled(_ context.Context, subscriptionID, resourceType string, previous, signalledAt null.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	overage, ok := s.Overages[OverageKey{SubscriptionID: subscriptionID, ResourceType: resourceType}]
+	if !ok || overage.SignalledAt.Valid != previous.Valid || !overage.SignalledAt.Time.Equal(previous.Time) {
+		return false, nil
+	}
+	overage.SignalledAt = signalledAt
+	return true, nil
+}
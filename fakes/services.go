@@ -0,0 +1,124 @@
+package fakes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+)
+
+var _ cpuhours.QMSClient = (*QMS)(nil)
+
+// Update is an update that was sent to QMS.
+type Update struct {
+	Username string
+	Update   *qms.Update
+}
+
+// QMS is an in-memory cpuhours.QMSClient. Usage updates are recorded and applied to the users' subscriptions.
+type QMS struct {
+	// Subscriptions are keyed by username without the domain suffix.
+	Subscriptions map[string]*qms.Subscription
+
+	// Err is returned instead of accepting updates when it's set.
+	Err error
+
+	// Reject is called with each update when it's set, and the update is rejected if it returns an error.
+	Reject func(username string, update *qms.Update) error
+
+	updates []Update
+	mu      sync.Mutex
+}
+
+// NewQMS returns a *QMS without any subscriptions.
+func NewQMS() *QMS {
+	return &QMS{Subscriptions: make(map[string]*qms.Subscription)}
+}
+
+// AddUserUpdate records an update and applies usage updates to the user's subscription, if there is one.
+func (q *QMS) AddUserUpdate(_ context.Context, username string, update *qms.Update) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.Err != nil {
+		return q.Err
+	}
+
+	username = clients.StripUsernameSuffix(username)
+	if q.Reject != nil {
+		if err := q.Reject(username, update); err != nil {
+			return err
+		}
+	}
+
+	q.updates = append(q.updates, Update{Username: username, Update: update})
+
+	subscription, ok := q.Subscriptions[username]
+	if !ok || update.ValueType != "usages" {
+		return nil
+	}
+
+	var usage *qms.Usage
+	for _, u := range subscription.Usages {
+		if u.GetResourceType().GetName() == update.GetResourceType().GetName() {
+			usage = u
+			break
+		}
+	}
+	if usage == nil {
+		usage = &qms.Usage{ResourceType: update.ResourceType, SubscriptionId: subscription.Uuid}
+		subscription.Usages = append(subscription.Usages, usage)
+	}
+
+	switch update.GetOperation().GetName() {
+	case "ADD":
+		usage.Usage += update.Value
+	case "SET":
+		usage.Usage = update.Value
+	}
+
+	return nil
+}
+
+// GetUserSubscription returns the user's subscription, or an HTTP 404 error if there isn't one.
+func (q *QMS) GetUserSubscription(_ context.Context, username string) (*qms.Subscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	subscription, ok := q.Subscriptions[clients.StripUsernameSuffix(username)]
+	if !ok {
+		return nil, clients.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no subscription found for %s", username))
+	}
+	return subscription, nil
+}
+
+// Updates returns the updates that were accepted, in the order they were sent.
+func (q *QMS) Updates() []Update {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Update(nil), q.updates...)
+}
+
+// DataUsage is an in-memory summarizer.DataUsageLookup.
+type DataUsage struct {
+	// Usages are keyed by username.
+	Usages map[string]*clients.UserDataUsage
+}
+
+// NewDataUsage returns a *DataUsage without any usage.
+func NewDataUsage() *DataUsage {
+	return &DataUsage{Usages: make(map[string]*clients.UserDataUsage)}
+}
+
+// GetUsageSummary returns the user's data usage, or an HTTP 404 error if there isn't any.
+func (d *DataUsage) GetUsageSummary(_ context.Context, username string) (*clients.UserDataUsage, error) {
+	usage, ok := d.Usages[username]
+	if !ok {
+		return nil, clients.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no data usage found for %s", username))
+	}
+	return usage, nil
+}
@@ -0,0 +1,464 @@
+// Package fakes contains in-memory implementations of the storage and service interfaces used by the usage
+// calculation and summary code, so that it can be tested without a database or network access.
+package fakes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+)
+
+var _ cpuhours.Store = (*Store)(nil)
+
+// Accounting contains the job status update times recorded for an analysis.
+type Accounting struct {
+	SubmittedAt null.Time
+	StartedAt   null.Time
+	FinishedAt  null.Time
+	FinalState  string
+}
+
+// Finalization is an analysis step whose usage calculation was deferred.
+type Finalization struct {
+	db.Finalization
+	Status      string
+	FallbackEnd null.Time
+	Error       null.String
+}
+
+// Store is an in-memory cpuhours.Store that also looks up users' current CPU hours like *db.Database does. The
+// exported fields can be used to set up and inspect its contents, but shouldn't be changed while it's in use.
+//
+// Transactions work on a copy of the contents that replaces the original when the transaction succeeds. They're run
+// one at a time, and changes made outside of a transaction while one is running are lost when it succeeds.
+type Store struct {
+	// Users are keyed by ID.
+	Users map[string]*db.User
+
+	// Analyses are keyed by ID. The accounting times are filled in from Accounting when they're looked up.
+	Analyses map[string]*db.Analysis
+
+	// Steps are keyed by external ID.
+	Steps map[string]*db.AnalysisStep
+
+	// Accounting is keyed by analysis ID.
+	Accounting map[string]*Accounting
+
+	// CPUHours contains the current CPU hours totals, keyed by username.
+	CPUHours map[string]*db.CPUHours
+
+	// Finalizations are keyed by external ID.
+	Finalizations map[string]*Finalization
+
+	AuditLog    []*db.AuditEntry
+	Adjustments []*db.UsageAdjustment
+
+	// AdjustmentErrors contains the reasons that failed adjustments were rejected, keyed by adjustment ID.
+	AdjustmentErrors map[string]string
+
+	mu   sync.Mutex
+	txMu sync.Mutex
+	inTx bool
+}
+
+// NewStore returns an empty *Store.
+func NewStore() *Store {
+	return &Store{
+		Users:            make(map[string]*db.User),
+		Analyses:         make(map[string]*db.Analysis),
+		Steps:            make(map[string]*db.AnalysisStep),
+		Accounting:       make(map[string]*Accounting),
+		CPUHours:         make(map[string]*db.CPUHours),
+		Finalizations:    make(map[string]*Finalization),
+		AdjustmentErrors: make(map[string]string),
+	}
+}
+
+// AddUser adds a user to the store.
+func (s *Store) AddUser(id, username string) *db.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := &db.User{ID: id, Username: username}
+	s.Users[id] = user
+	return user
+}
+
+// AddAnalysis adds an analysis to the store.
+func (s *Store) AddAnalysis(analysis *db.Analysis) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Analyses[analysis.ID] = analysis
+}
+
+// AddStep adds an analysis step to the store.
+func (s *Store) AddStep(step *db.AnalysisStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Steps[step.ExternalID] = step
+}
+
+// clone returns a copy of the store's contents. The copied entries can be changed without affecting s.
+func (s *Store) clone() *Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := NewStore()
+	for id, user := range s.Users {
+		copied := *user
+		c.Users[id] = &copied
+	}
+	for id, analysis := range s.Analyses {
+		copied := *analysis
+		c.Analyses[id] = &copied
+	}
+	for id, step := range s.Steps {
+		copied := *step
+		c.Steps[id] = &copied
+	}
+	for id, accounting := range s.Accounting {
+		copied := *accounting
+		c.Accounting[id] = &copied
+	}
+	for username, cpuHours := range s.CPUHours {
+		copied := *cpuHours
+		c.CPUHours[username] = &copied
+	}
+	for id, finalization := range s.Finalizations {
+		copied := *finalization
+		c.Finalizations[id] = &copied
+	}
+	c.AuditLog = append(c.AuditLog, s.AuditLog...)
+	for _, adjustment := range s.Adjustments {
+		copied := *adjustment
+		c.Adjustments = append(c.Adjustments, &copied)
+	}
+	for id, reason := range s.AdjustmentErrors {
+		c.AdjustmentErrors[id] = reason
+	}
+
+	return c
+}
+
+// WithTx runs fn with a copy of the store, which replaces the store's contents if fn returns nil.
+func (s *Store) WithTx(context context.Context, fn func(tx cpuhours.Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := s.clone()
+	tx.inTx = true
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Users = tx.Users
+	s.Analyses = tx.Analyses
+	s.Steps = tx.Steps
+	s.Accounting = tx.Accounting
+	s.CPUHours = tx.CPUHours
+	s.Finalizations = tx.Finalizations
+	s.AuditLog = tx.AuditLog
+	s.Adjustments = tx.Adjustments
+	s.AdjustmentErrors = tx.AdjustmentErrors
+
+	return nil
+}
+
+// StepByExternalID returns a copy of the analysis step with the given external ID.
+func (s *Store) StepByExternalID(_ context.Context, externalID string) (*db.AnalysisStep, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	step, ok := s.Steps[externalID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *step
+	return &copied, nil
+}
+
+// AnalysisWithoutUser returns a copy of the analysis with the given ID, including its accounting times.
+func (s *Store) AnalysisWithoutUser(_ context.Context, analysisID string) (*db.Analysis, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	analysis, ok := s.Analyses[analysisID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	copied := *analysis
+	if accounting, ok := s.Accounting[analysisID]; ok {
+		copied.AccountingStart = accounting.StartedAt
+		copied.AccountingEnd = accounting.FinishedAt
+	}
+	return &copied, nil
+}
+
+// GetAnalysisIDByExternalID returns the ID of the analysis that the step with the given external ID belongs to.
+func (s *Store) GetAnalysisIDByExternalID(_ context.Context, externalID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	step, ok := s.Steps[externalID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return step.JobID, nil
+}
+
+// Username returns the username of the user with the given ID.
+func (s *Store) Username(_ context.Context, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.Users[userID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return user.Username, nil
+}
+
+// UserByUsername returns a copy of the user with the given username.
+func (s *Store) UserByUsername(_ context.Context, username string) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.Users {
+		if user.Username == username {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// accounting returns the accounting times for an analysis, adding them if they don't exist yet. s.mu must be held.
+func (s *Store) accounting(analysisID string) *Accounting {
+	accounting, ok := s.Accounting[analysisID]
+	if !ok {
+		accounting = &Accounting{}
+		s.Accounting[analysisID] = accounting
+	}
+	return accounting
+}
+
+// earliest returns the earlier of the recorded time and t.
+func earliest(recorded null.Time, t time.Time) null.Time {
+	if recorded.Valid && recorded.Time.Before(t) {
+		return recorded
+	}
+	return null.TimeFrom(t.UTC())
+}
+
+// RecordSubmitted records when an analysis was submitted, keeping the earliest time.
+func (s *Store) RecordSubmitted(_ context.Context, analysisID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounting := s.accounting(analysisID)
+	accounting.SubmittedAt = earliest(accounting.SubmittedAt, at)
+	return nil
+}
+
+// RecordStarted records when an analysis started running, keeping the earliest time.
+func (s *Store) RecordStarted(_ context.Context, analysisID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounting := s.accounting(analysisID)
+	accounting.StartedAt = earliest(accounting.StartedAt, at)
+	return nil
+}
+
+// RecordFinished records when an analysis reached a final state along with the state itself.
+func (s *Store) RecordFinished(_ context.Context, analysisID, state string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounting := s.accounting(analysisID)
+	accounting.FinishedAt = null.TimeFrom(at.UTC())
+	accounting.FinalState = state
+	return nil
+}
+
+// SetStepUsageLastUpdate sets the usage last update time of an analysis step. Like the database, the time is only
+// stored to the nearest microsecond.
+func (s *Store) SetStepUsageLastUpdate(_ context.Context, externalID string, usagetime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if step, ok := s.Steps[externalID]; ok {
+		step.UsageLastUpdate = null.TimeFrom(usagetime.Round(time.Microsecond).UTC())
+	}
+	return nil
+}
+
+// SetUsageLastUpdate moves the usage last update time of an analysis forward.
+func (s *Store) SetUsageLastUpdate(_ context.Context, analysisID string, usagetime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	analysis, ok := s.Analyses[analysisID]
+	if ok && (!analysis.UsageLastUpdate.Valid || usagetime.After(analysis.UsageLastUpdate.Time)) {
+		analysis.UsageLastUpdate = null.TimeFrom(usagetime.UTC())
+	}
+	return nil
+}
+
+// AddAuditEntry appends an entry to the audit log, filling in its ID and recording time.
+func (s *Store) AddAuditEntry(_ context.Context, entry *db.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = int64(len(s.AuditLog) + 1)
+	entry.RecordedAt = time.Now().UTC()
+	copied := *entry
+	s.AuditLog = append(s.AuditLog, &copied)
+	return nil
+}
+
+// AddUsageAdjustment records a pending adjustment, filling in its ID, status, and creation time.
+func (s *Store) AddUsageAdjustment(_ context.Context, adjustment *db.UsageAdjustment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	adjustment.ID = fmt.Sprintf("adjustment-%d", len(s.Adjustments)+1)
+	adjustment.Status = db.AdjustmentPending
+	adjustment.CreatedAt = time.Now().UTC()
+	copied := *adjustment
+	s.Adjustments = append(s.Adjustments, &copied)
+	return nil
+}
+
+// CompleteUsageAdjustment marks an adjustment as applied.
+func (s *Store) CompleteUsageAdjustment(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, adjustment := range s.Adjustments {
+		if adjustment.ID == id {
+			adjustment.Status = db.AdjustmentApplied
+		}
+	}
+	return nil
+}
+
+// FailUsageAdjustment marks an adjustment as failed, recording the reason in AdjustmentErrors.
+func (s *Store) FailUsageAdjustment(_ context.Context, id, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, adjustment := range s.Adjustments {
+		if adjustment.ID == id {
+			adjustment.Status = db.AdjustmentFailed
+			s.AdjustmentErrors[id] = reason
+		}
+	}
+	return nil
+}
+
+// DeferFinalization schedules an analysis step to have its usage finalized later.
+func (s *Store) DeferFinalization(_ context.Context, analysisID, externalID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if finalization, ok := s.Finalizations[externalID]; ok {
+		finalization.Status = "pending"
+		finalization.Error = null.String{}
+		return nil
+	}
+
+	s.Finalizations[externalID] = &Finalization{
+		Finalization: db.Finalization{AnalysisID: analysisID, ExternalID: externalID, NextAttemptAt: time.Now().UTC()},
+		Status:       "pending",
+	}
+	return nil
+}
+
+// ClaimFinalizations returns up to limit pending finalizations that are due, incrementing their attempt counts and
+// pushing back their next attempts.
+func (s *Store) ClaimFinalizations(_ context.Context, limit int, retryDelay time.Duration) ([]db.Finalization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	due := make([]*Finalization, 0)
+	for _, finalization := range s.Finalizations {
+		if finalization.Status == "pending" && !finalization.NextAttemptAt.After(now) {
+			due = append(due, finalization)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]db.Finalization, 0, len(due))
+	for _, finalization := range due {
+		finalization.Attempts++
+		finalization.NextAttemptAt = now.Add(time.Duration(finalization.Attempts) * retryDelay)
+		claimed = append(claimed, finalization.Finalization)
+	}
+	return claimed, nil
+}
+
+// CompleteFinalization removes an analysis step from the pending finalizations.
+func (s *Store) CompleteFinalization(_ context.Context, externalID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Finalizations, externalID)
+	return nil
+}
+
+// RecordFinalizationFallback records that an analysis step's usage was finalized with a substitute end date.
+func (s *Store) RecordFinalizationFallback(_ context.Context, externalID string, fallbackEnd time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if finalization, ok := s.Finalizations[externalID]; ok {
+		finalization.Status = "fallback"
+		finalization.FallbackEnd = null.TimeFrom(fallbackEnd.UTC())
+	}
+	return nil
+}
+
+// FailFinalization records that an analysis step's usage couldn't be finalized.
+func (s *Store) FailFinalization(_ context.Context, externalID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if finalization, ok := s.Finalizations[externalID]; ok {
+		finalization.Status = "failed"
+		finalization.Error = null.StringFrom(reason)
+	}
+	return nil
+}
+
+// CurrentCPUHoursForUser returns a copy of the user's current CPU hours total.
+func (s *Store) CurrentCPUHoursForUser(_ context.Context, username string) (*db.CPUHours, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cpuHours, ok := s.CPUHours[username]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *cpuHours
+	return &copied, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/auth"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AdjustmentRequestBody is the request body for adjusting a user's CPU hours.
+type AdjustmentRequestBody struct {
+	Operation string  `json:"operation"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+}
+
+// AdjustCPUHours is an echo request handler for requests to add CPU hours to, subtract CPU hours from, or reset a
+// user's CPU hours. The adjustment is attributed to the authenticated administrator.
+func (a *App) AdjustCPUHours(c echo.Context) error {
+	context := c.Request().Context()
+	user := c.Param("username")
+	log := log.WithFields(logrus.Fields{"context": "adjust CPU hours", "user": user}).WithContext(context)
+
+	if !a.qmsEnabled {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "usage adjustments require QMS to be enabled")
+	}
+
+	var body AdjustmentRequestBody
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	adjustment, err := a.cpuHours.Adjust(context, &cpuhours.AdjustmentRequest{
+		Username:  a.FixUsername(user),
+		Operation: body.Operation,
+		Amount:    body.Amount,
+		Reason:    body.Reason,
+		Actor:     auth.GetIdentity(c).Username,
+	})
+	switch {
+	case errors.Is(err, cpuhours.ErrInvalidAdjustment):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", user))
+	case err != nil:
+		log.Error(err)
+		var httpErr *clients.HTTPError
+		if errors.As(err, &httpErr) {
+			return echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("QMS rejected the adjustment: %s", err))
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, adjustment)
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// GetAppUsage is an echo request handler for requests for statistics about how much compute an app's analyses
+// consumed during a time window. The window defaults to the last 30 days.
+func (a *App) GetAppUsage(c echo.Context) error {
+	context := c.Request().Context()
+	appID := c.Param("app_id")
+	log := log.WithFields(logrus.Fields{"context": "get app usage", "appID": appID}).WithContext(context)
+
+	from, to, err := parseWindow(c)
+	if err != nil {
+		return err
+	}
+
+	usage, err := db.New(a.database).AppUsage(context, appID, from, to)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// parseTimeParam parses a query parameter containing either an RFC 3339 timestamp or a date. The zero time is
+// returned if the parameter isn't present.
+func parseTimeParam(c echo.Context, name string) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp or a date", name))
+}
+
+// parseWindow parses the from and to query parameters for a report's time window. The window ends at the current
+// time and lasts 30 days unless the parameters say otherwise.
+func parseWindow(c echo.Context) (time.Time, time.Time, error) {
+	from, err := parseTimeParam(c, "from")
+	if err != nil {
+		return from, from, err
+	}
+	to, err := parseTimeParam(c, "to")
+	if err != nil {
+		return from, to, err
+	}
+
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -30)
+	}
+	if !from.Before(to) {
+		return from, to, echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	return from, to, nil
+}
+
+// parseIntParam parses an integer query parameter, returning the default if the parameter isn't present.
+func parseIntParam(c echo.Context, name string, def, min, max int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min || parsed > max {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be an integer from %d to %d", name, min, max))
+	}
+
+	return parsed, nil
+}
+
+// GetAuditLog is an echo request handler for requests to list the changes made to users' usage. The results can be
+// filtered by user, analysis, actor, and date range, and are returned most recent first.
+func (a *App) GetAuditLog(c echo.Context) error {
+	var err error
+
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "get audit log"}).WithContext(context)
+
+	filter := &db.AuditFilter{
+		AnalysisID: c.QueryParam("analysis_id"),
+		Actor:      c.QueryParam("actor"),
+	}
+	if filter.AnalysisID != "" {
+		if _, err = uuid.Parse(filter.AnalysisID); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "analysis_id must be a UUID")
+		}
+	}
+	if user := c.QueryParam("user"); user != "" {
+		filter.Username = a.FixUsername(user)
+	}
+	if filter.From, err = parseTimeParam(c, "from"); err != nil {
+		return err
+	}
+	if filter.To, err = parseTimeParam(c, "to"); err != nil {
+		return err
+	}
+	if filter.Limit, err = parseIntParam(c, "limit", defaultAuditLimit, 1, maxAuditLimit); err != nil {
+		return err
+	}
+	if filter.Offset, err = parseIntParam(c, "offset", 0, 0, math.MaxInt32); err != nil {
+		return err
+	}
+
+	entries, err := db.New(a.database).AuditEntries(context, filter)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"entries": entries})
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/samples"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// The sample formats accepted for each request content type.
+var sampleFormats = map[string]samples.Format{
+	"application/json":     samples.FormatJSON,
+	"application/x-ndjson": samples.FormatJSONL,
+	"text/csv":             samples.FormatCSV,
+}
+
+// The dimensions the efficiency report can be grouped by.
+var efficiencyDimensions = map[string]db.ReportDimension{
+	"analysis": db.ReportByAnalysis,
+	"app":      db.ReportByApp,
+	"user":     db.ReportByUser,
+}
+
+// AddUsageSamples is an echo request handler for requests to import CPU usage samples. The request body may be a
+// JSON array, JSON Lines, or CSV, depending on its content type.
+func (a *App) AddUsageSamples(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "add usage samples"}).WithContext(context)
+
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		mediaType = "application/json"
+	}
+	format, ok := sampleFormats[mediaType]
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "samples must be sent as application/json, application/x-ndjson, or text/csv")
+	}
+
+	count, err := samples.Import(context, db.New(a.database), c.Request().Body, format)
+	switch {
+	case errors.Is(err, samples.ErrInvalid):
+		log.WithError(err).Warnf("imported %d samples before finding an invalid one", count)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("imported %d samples before failing: %s", count, err))
+	case err != nil:
+		log.WithError(err).Errorf("imported %d samples before failing", count)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("imported %d samples before failing", count))
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"imported": count})
+}
+
+// GetReservationEfficiency is an echo request handler for requests comparing the CPU reserved for analyses to the
+// CPU they actually used, grouped by analysis, app, or user. The least efficient are listed first.
+func (a *App) GetReservationEfficiency(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "reservation efficiency report"}).WithContext(context)
+
+	by := c.QueryParam("by")
+	if by == "" {
+		by = "analysis"
+	}
+	dimension, ok := efficiencyDimensions[by]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "by must be one of analysis, app, or user")
+	}
+
+	from, to, err := parseWindow(c)
+	if err != nil {
+		return err
+	}
+	limit, err := parseIntParam(c, "limit", defaultReportLimit, 1, maxReportLimit)
+	if err != nil {
+		return err
+	}
+
+	report, err := db.New(a.database).ReservationEfficiency(context, dimension, from, to, limit)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if dimension == db.ReportByUser {
+		for i := range report {
+			report[i].Name = clients.StripUsernameSuffix(report[i].Name)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"by":      by,
+		"entries": report,
+	})
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/auth"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// EstimateRequestBody is the request body for estimating the CPU hours an analysis will use. The millicores and
+// duration default to the app's average reservation and median runtime over the last 30 days when they're omitted.
+type EstimateRequestBody struct {
+	Username   string `json:"username"`
+	AppID      string `json:"app_id"`
+	Millicores int64  `json:"millicores"`
+	Duration   string `json:"duration"`
+}
+
+// Estimate is the response body for CPU hour estimates. The quota fields are null if the user doesn't have a CPU
+// hours quota, in which case the estimate always fits.
+type Estimate struct {
+	Username        string   `json:"username"`
+	AppID           string   `json:"app_id"`
+	Millicores      int64    `json:"millicores"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	CPUHours        float64  `json:"cpu_hours"`
+	Quota           *float64 `json:"quota"`
+	Usage           *float64 `json:"usage"`
+	Remaining       *float64 `json:"remaining"`
+	Fits            bool     `json:"fits"`
+}
+
+// estimateUser returns the user an estimate is for. Authenticated callers get estimates for themselves unless
+// they're administrators, who can ask about anyone.
+func estimateUser(c echo.Context, requested string) (string, error) {
+	identity := auth.GetIdentity(c)
+	switch {
+	case identity == nil && requested == "":
+		return "", echo.NewHTTPError(http.StatusBadRequest, "username is required")
+	case identity == nil:
+		return requested, nil
+	case requested == "":
+		return identity.Username, nil
+	case !identity.Admin && clients.StripUsernameSuffix(requested) != identity.Username:
+		return "", echo.NewHTTPError(http.StatusForbidden, "users may only estimate their own resource usage")
+	default:
+		return requested, nil
+	}
+}
+
+// fillEstimateDefaults fills in the millicores and duration that weren't included in the request from the app's
+// recent analyses.
+func (a *App) fillEstimateDefaults(c echo.Context, appID string, millicores *int64, duration *time.Duration) error {
+	if *millicores > 0 && *duration > 0 {
+		return nil
+	}
+
+	to := time.Now()
+	usage, err := db.New(a.database).AppUsage(c.Request().Context(), appID, to.AddDate(0, 0, -30), to)
+	if err != nil {
+		return err
+	}
+
+	if *millicores == 0 {
+		if !usage.AvgMillicores.Valid {
+			return echo.NewHTTPError(http.StatusBadRequest, "millicores is required for apps without recent analyses")
+		}
+		*millicores = int64(usage.AvgMillicores.Float64)
+	}
+
+	if *duration == 0 {
+		if !usage.MedianRuntimeSeconds.Valid {
+			return echo.NewHTTPError(http.StatusBadRequest, "duration is required for apps without recent analyses")
+		}
+		*duration = time.Duration(usage.MedianRuntimeSeconds.Float64 * float64(time.Second))
+	}
+
+	return nil
+}
+
+// EstimateCPUHours is an echo request handler for requests to estimate how many CPU hours an analysis will use and
+// whether that fits in the remainder of the user's CPU hours quota. The estimate is calculated the same way that
+// analyses are charged.
+func (a *App) EstimateCPUHours(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "estimate CPU hours"}).WithContext(context)
+
+	var body EstimateRequestBody
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	if body.AppID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "app_id is required")
+	}
+	if body.Millicores < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "millicores must not be negative")
+	}
+
+	var duration time.Duration
+	if body.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(body.Duration); err != nil || duration < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "duration must be a non-negative duration such as 2h30m")
+		}
+	}
+
+	user, err := estimateUser(c, body.Username)
+	if err != nil {
+		return err
+	}
+	log = log.WithFields(logrus.Fields{"user": user, "appID": body.AppID})
+
+	millicores := body.Millicores
+	if err = a.fillEstimateDefaults(c, body.AppID, &millicores, &duration); err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			log.Error(err)
+		}
+		return err
+	}
+
+	cpuHours, err := cpuhours.Calculate(millicores, duration)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	cpuHoursFloat, err := cpuHours.Float64()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	estimate := &Estimate{
+		Username:        clients.StripUsernameSuffix(user),
+		AppID:           body.AppID,
+		Millicores:      millicores,
+		DurationSeconds: duration.Seconds(),
+		CPUHours:        cpuHoursFloat,
+		Fits:            true,
+	}
+
+	// Quotas are only tracked when QMS is enabled.
+	if a.qmsEnabled {
+		subscription, err := a.subscriptions.GetUserSubscription(context, a.FixUsername(user))
+		switch {
+		case clients.GetStatusCode(err) == http.StatusNotFound:
+			// Users without a subscription don't have a quota yet.
+			subscription = nil
+		case err != nil:
+			log.Error(err)
+			return echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("unable to look up the subscription: %s", err))
+		}
+
+		if quota, usage, found := clients.QuotaAndUsage(subscription, clients.ResourceTypeCPUHours); found {
+			remaining := quota - usage
+			estimate.Quota = &quota
+			estimate.Usage = &usage
+			estimate.Remaining = &remaining
+			estimate.Fits = cpuHoursFloat <= remaining
+		}
+	}
+
+	return c.JSON(http.StatusOK, estimate)
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/export"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// ExportUsage is an echo request handler for requests to export usage records for a date range as CSV or JSON
+// Lines. The records are streamed to the caller as they're read from the database.
+func (a *App) ExportUsage(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "export usage", "kind": c.Param("kind")}).WithContext(context)
+
+	kind, err := export.ParseKind(c.Param("kind"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	formatName := c.QueryParam("format")
+	if formatName == "" {
+		formatName = string(export.FormatCSV)
+	}
+	format, err := export.ParseFormat(formatName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	from, err := parseTimeParam(c, "from")
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeParam(c, "to")
+	if err != nil {
+		return err
+	}
+	if from.IsZero() || to.IsZero() || !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to are required, and from must be before to")
+	}
+
+	filename := fmt.Sprintf("%s-%s-%s.%s", kind, from.Format(time.DateOnly), to.Format(time.DateOnly), format)
+	c.Response().Header().Set(echo.HeaderContentType, format.ContentType())
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The status has already been sent, so errors can only be logged.
+	if err = export.Export(context, db.New(a.database), kind, format, from, to, c.Response()); err != nil {
+		log.WithError(err).Error("the export failed after it was started")
+	}
+
+	return nil
+}
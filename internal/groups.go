@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/cyverse-de/resource-usage-api/auth"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Where a group was defined.
+const (
+	groupSourceConfig   = "config"
+	groupSourceDatabase = "database"
+)
+
+// GroupMemberUsage is a group member's share of the group's usage.
+type GroupMemberUsage struct {
+	Username string     `json:"username"`
+	CPUHours float64    `json:"cpu_hours"`
+	Quota    null.Float `json:"quota"`
+
+	// The fraction of the group's CPU hours that the member used.
+	Share float64 `json:"share"`
+}
+
+// GroupSummary is the response body for group usage summaries. The quota fields are null if the group doesn't have
+// a quota.
+type GroupSummary struct {
+	Name      string              `json:"name"`
+	Source    string              `json:"source"`
+	CPUHours  float64             `json:"cpu_hours"`
+	Quota     null.Float          `json:"quota"`
+	Remaining null.Float          `json:"remaining"`
+	Members   []*GroupMemberUsage `json:"members"`
+}
+
+// GroupRequestBody is the request body for creating or replacing a group.
+type GroupRequestBody struct {
+	Members       []string   `json:"members"`
+	CPUHoursQuota null.Float `json:"cpu_hours_quota"`
+}
+
+// groupsFromConfiguration returns the groups defined in the configuration with the domain suffix added to the
+// members' usernames.
+func (a *App) groupsFromConfiguration(groups map[string]*db.UsageGroup) map[string]*db.UsageGroup {
+	fixed := make(map[string]*db.UsageGroup, len(groups))
+	for name, group := range groups {
+		members := make([]string, len(group.Members))
+		for i, member := range group.Members {
+			members[i] = a.FixUsername(clients.StripUsernameSuffix(member))
+		}
+		fixed[name] = &db.UsageGroup{Name: name, CPUHoursQuota: group.CPUHoursQuota, Members: members}
+	}
+	return fixed
+}
+
+// findGroup looks up a group, checking the groups defined in the configuration before the ones in the database.
+func (a *App) findGroup(c echo.Context, name string) (*db.UsageGroup, string, error) {
+	if group, ok := a.groups[name]; ok {
+		return group, groupSourceConfig, nil
+	}
+
+	group, err := db.New(a.database).UsageGroup(c.Request().Context(), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return group, groupSourceDatabase, nil
+}
+
+// canViewGroup returns true if the caller is allowed to see a group's usage. Administrators can see every group,
+// and users can see the groups they belong to.
+func canViewGroup(c echo.Context, group *db.UsageGroup) bool {
+	identity := auth.GetIdentity(c)
+	if identity == nil || identity.Admin {
+		return true
+	}
+
+	for _, member := range group.Members {
+		if clients.StripUsernameSuffix(member) == identity.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// maxConcurrentLookups is the most subscriptions that are looked up in QMS at the same time for a group summary.
+const maxConcurrentLookups = 8
+
+// memberUsage returns the CPU hours that each member of a group has used in their current usage periods, keyed by
+// username. The usage comes from QMS if it's enabled, in which case the members' own quotas are included as well.
+// The members' subscriptions are looked up concurrently, and a failed lookup is returned as a 502 error.
+func (a *App) memberUsage(c echo.Context, group *db.UsageGroup) (map[string]*GroupMemberUsage, error) {
+	context := c.Request().Context()
+	usage := make(map[string]*GroupMemberUsage, len(group.Members))
+	for _, member := range group.Members {
+		usage[member] = &GroupMemberUsage{Username: clients.StripUsernameSuffix(member)}
+	}
+
+	if !a.qmsEnabled {
+		totals, err := db.New(a.database).CurrentCPUHoursForUsers(context, group.Members)
+		if err != nil {
+			return nil, err
+		}
+		for member, total := range totals {
+			if memberUsage, ok := usage[member]; ok {
+				memberUsage.CPUHours = total
+			}
+		}
+		return usage, nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		slots    = make(chan struct{}, maxConcurrentLookups)
+	)
+	for member, memberUsage := range usage {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			subscription, err := a.subscriptions.GetUserSubscription(context, member)
+			if clients.GetStatusCode(err) == http.StatusNotFound {
+				// Members without subscriptions haven't used anything yet.
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("unable to look up the subscription for %s: %w", memberUsage.Username, err)
+				}
+				return
+			}
+
+			quota, used, found := clients.QuotaAndUsage(subscription, clients.ResourceTypeCPUHours)
+			memberUsage.CPUHours = used
+			if found {
+				memberUsage.Quota = null.FloatFrom(quota)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, echo.NewHTTPError(http.StatusBadGateway, firstErr.Error()).SetInternal(firstErr)
+	}
+
+	return usage, nil
+}
+
+// GetGroupSummary is an echo request handler for requests for a group's usage, broken down by member and compared
+// to the group's quota.
+func (a *App) GetGroupSummary(c echo.Context) error {
+	context := c.Request().Context()
+	name := c.Param("name")
+	log := log.WithFields(logrus.Fields{"context": "get group summary", "group": name}).WithContext(context)
+
+	group, source, err := a.findGroup(c, name)
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			log.Error(err)
+		}
+		return err
+	}
+
+	// Callers who can't see the group are told that it doesn't exist so that group names aren't leaked.
+	if !canViewGroup(c, group) {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+
+	usage, err := a.memberUsage(c, group)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	summary := &GroupSummary{
+		Name:    group.Name,
+		Source:  source,
+		Quota:   group.CPUHoursQuota,
+		Members: make([]*GroupMemberUsage, 0, len(usage)),
+	}
+	for _, member := range usage {
+		summary.CPUHours += member.CPUHours
+		summary.Members = append(summary.Members, member)
+	}
+	for _, member := range summary.Members {
+		if summary.CPUHours > 0 {
+			member.Share = member.CPUHours / summary.CPUHours
+		}
+	}
+	sort.Slice(summary.Members, func(i, j int) bool {
+		if summary.Members[i].CPUHours != summary.Members[j].CPUHours {
+			return summary.Members[i].CPUHours > summary.Members[j].CPUHours
+		}
+		return summary.Members[i].Username < summary.Members[j].Username
+	})
+	if summary.Quota.Valid {
+		summary.Remaining = null.FloatFrom(summary.Quota.Float64 - summary.CPUHours)
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+// checkGroupIsStored returns an error if the named group is defined in the configuration, since those groups can't
+// be changed through the API.
+func (a *App) checkGroupIsStored(name string) error {
+	if _, ok := a.groups[name]; ok {
+		return echo.NewHTTPError(
+			http.StatusConflict,
+			fmt.Sprintf("group %s is defined in the configuration and can't be changed", name),
+		)
+	}
+	return nil
+}
+
+// SetGroup is an echo request handler for requests to create a group in the database or replace its members and
+// quota.
+func (a *App) SetGroup(c echo.Context) error {
+	context := c.Request().Context()
+	name := c.Param("name")
+	log := log.WithFields(logrus.Fields{"context": "set group", "group": name}).WithContext(context)
+
+	if err := a.checkGroupIsStored(name); err != nil {
+		return err
+	}
+
+	var body GroupRequestBody
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if len(body.Members) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "members must list at least one user")
+	}
+	if body.CPUHoursQuota.Valid && body.CPUHoursQuota.Float64 <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "cpu_hours_quota must be positive")
+	}
+
+	group := &db.UsageGroup{Name: name, CPUHoursQuota: body.CPUHoursQuota}
+	for _, member := range body.Members {
+		if member == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "members must not be empty")
+		}
+		group.Members = append(group.Members, a.FixUsername(clients.StripUsernameSuffix(member)))
+	}
+
+	if err := db.New(a.database).SetUsageGroup(context, group); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return c.JSON(http.StatusOK, group)
+}
+
+// DeleteGroup is an echo request handler for requests to delete a group from the database.
+func (a *App) DeleteGroup(c echo.Context) error {
+	context := c.Request().Context()
+	name := c.Param("name")
+	log := log.WithFields(logrus.Fields{"context": "delete group", "group": name}).WithContext(context)
+
+	if err := a.checkGroupIsStored(name); err != nil {
+		return err
+	}
+
+	err := db.New(a.database).DeleteUsageGroup(context, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
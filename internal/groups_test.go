@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/auth"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/fakes"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+)
+
+const userSuffix = "iplantcollaborative.org"
+
+// headerAuthenticator identifies callers by the username in the Authorization header. The user named admin is an
+// administrator.
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	username := r.Header.Get(echo.HeaderAuthorization)
+	if username == "" {
+		return nil, errors.New("no username")
+	}
+	return &auth.Identity{Username: username, Admin: username == "admin"}, nil
+}
+
+// failingLookup is a SubscriptionLookup that always fails.
+type failingLookup struct{}
+
+func (failingLookup) GetUserSubscription(_ context.Context, _ string) (*qms.Subscription, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newGroupTestApp(subscriptions SubscriptionLookup) *App {
+	app := &App{
+		router:        echo.New(),
+		userSuffix:    userSuffix,
+		qmsEnabled:    true,
+		subscriptions: subscriptions,
+		authenticator: headerAuthenticator{},
+	}
+	app.groups = app.groupsFromConfiguration(map[string]*db.UsageGroup{
+		"smith-lab": {CPUHoursQuota: null.FloatFrom(100), Members: []string{"alice", "bob", "carol"}},
+	})
+	return app
+}
+
+func newSubscription(used float64) *qms.Subscription {
+	cpuHours := &qms.ResourceType{Name: clients.ResourceTypeCPUHours, Unit: "cpu hours"}
+	return &qms.Subscription{
+		Quotas: []*qms.Quota{{ResourceType: cpuHours, Quota: 50}},
+		Usages: []*qms.Usage{{ResourceType: cpuHours, Usage: used}},
+	}
+}
+
+func serve(app *App, method, path, username string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderAuthorization, username)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	app.Router().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetGroupSummary(t *testing.T) {
+	subscriptions := fakes.NewQMS()
+	subscriptions.Subscriptions["alice"] = newSubscription(30)
+	subscriptions.Subscriptions["bob"] = newSubscription(10)
+	app := newGroupTestApp(subscriptions)
+
+	rec := serve(app, http.MethodGet, "/groups/smith-lab/summary", "bob", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var summary GroupSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("unable to parse the summary: %s", err)
+	}
+
+	if summary.Source != groupSourceConfig || summary.CPUHours != 40 || summary.Remaining.Float64 != 60 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+
+	expected := []struct {
+		username string
+		cpuHours float64
+		share    float64
+		quota    null.Float
+	}{
+		{username: "alice", cpuHours: 30, share: 0.75, quota: null.FloatFrom(50)},
+		{username: "bob", cpuHours: 10, share: 0.25, quota: null.FloatFrom(50)},
+		{username: "carol"},
+	}
+	if len(summary.Members) != len(expected) {
+		t.Fatalf("expected %d members, got %d", len(expected), len(summary.Members))
+	}
+	for i, member := range summary.Members {
+		want := expected[i]
+		if member.Username != want.username || member.CPUHours != want.cpuHours ||
+			math.Abs(member.Share-want.share) > 1e-9 || member.Quota != want.quota {
+			t.Errorf("member %d: expected %+v, got %+v", i, want, member)
+		}
+	}
+}
+
+func TestGetGroupSummaryAccess(t *testing.T) {
+	tests := []struct {
+		username string
+		status   int
+	}{
+		{username: "alice", status: http.StatusOK},
+		{username: "admin", status: http.StatusOK},
+		{username: "dave", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			app := newGroupTestApp(fakes.NewQMS())
+			rec := serve(app, http.MethodGet, "/groups/smith-lab/summary", test.username, "")
+			if rec.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetGroupSummaryQMSFailure(t *testing.T) {
+	app := newGroupTestApp(failingLookup{})
+	rec := serve(app, http.MethodGet, "/groups/smith-lab/summary", "alice", "")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d: %s", http.StatusBadGateway, rec.Code, rec.Body.String())
+	}
+}
+
+func TestConfiguredGroupsCannotBeChanged(t *testing.T) {
+	body := fmt.Sprintf(`{"members": ["dave@%s"], "cpu_hours_quota": 10}`, userSuffix)
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			app := newGroupTestApp(fakes.NewQMS())
+			rec := serve(app, method, "/admin/groups/smith-lab", "admin", body)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("expected status %d, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
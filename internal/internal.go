@@ -1,12 +1,18 @@
 package internal
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/auth"
 	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
 	"github.com/cyverse-de/resource-usage-api/logging"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
@@ -16,6 +22,11 @@ import (
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "internal"})
 
+// SubscriptionLookup looks up users' current subscriptions in QMS.
+type SubscriptionLookup interface {
+	GetUserSubscription(context context.Context, username string) (*qms.Subscription, error)
+}
+
 // App encapsulates the application logic.
 type App struct {
 	database             *sqlx.DB
@@ -26,6 +37,10 @@ type App struct {
 	amqpUsageRoutingKey  string
 	qmsEnabled           bool
 	subscriptionsBaseURI string
+	subscriptions        SubscriptionLookup
+	authenticator        auth.Authenticator
+	cpuHours             *cpuhours.CPUHours
+	groups               map[string]*db.UsageGroup
 }
 
 // AppConfiguration contains the settings needed to configure the App.
@@ -37,6 +52,16 @@ type AppConfiguration struct {
 	AMQPUsageRoutingKey      string
 	QMSEnabled               bool
 	SubscriptionsBaseURI     string
+
+	// Authenticator authenticates requests. Requests aren't authenticated if
+	// it's nil.
+	Authenticator auth.Authenticator
+
+	// CPUHours is used to make manual adjustments to users' CPU hours.
+	CPUHours *cpuhours.CPUHours
+
+	// Groups are the usage groups defined in the configuration, keyed by name.
+	Groups map[string]*db.UsageGroup
 }
 
 func (a *App) FixUsername(username string) string {
@@ -58,6 +83,10 @@ func New(db *sqlx.DB, config *AppConfiguration) (*App, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create the data-usage-api client")
 	}
+	subscriptionsClient, err := clients.SubscriptionsClient(config.SubscriptionsBaseURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create the subscriptions client")
+	}
 
 	// Create the app instance.
 	app := &App{
@@ -69,7 +98,11 @@ func New(db *sqlx.DB, config *AppConfiguration) (*App, error) {
 		amqpUsageRoutingKey:  config.AMQPUsageRoutingKey,
 		qmsEnabled:           config.QMSEnabled,
 		subscriptionsBaseURI: config.SubscriptionsBaseURI,
+		subscriptions:        subscriptionsClient,
+		authenticator:        config.Authenticator,
+		cpuHours:             config.CPUHours,
 	}
+	app.groups = app.groupsFromConfiguration(config.Groups)
 
 	return app, nil
 }
@@ -77,13 +110,52 @@ func (a *App) HelloHandler(c echo.Context) error {
 	return c.String(http.StatusOK, "Hello from resource-usage-api")
 }
 
+// protect adds the authentication middleware and the given authorization
+// middleware to a group of routes. Nothing is added if authentication is
+// disabled.
+func (a *App) protect(group *echo.Group, authorize echo.MiddlewareFunc) {
+	if a.authenticator == nil {
+		return
+	}
+	group.Use(auth.Middleware(a.authenticator), authorize)
+}
+
 func (a *App) Router() *echo.Echo {
 	a.router.HTTPErrorHandler = logging.HTTPErrorHandler
 	a.router.GET("/", a.HelloHandler)
+	a.router.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
 
 	summaryRoute := a.router.Group("/summary/:username")
+	a.protect(summaryRoute, auth.RequireSelfOrAdmin("username"))
 	summaryRoute.GET("/", a.GetUserSummary)
 	summaryRoute.GET("", a.GetUserSummary)
 
+	appsRoute := a.router.Group("/apps/:app_id")
+	a.protect(appsRoute, auth.RequireIdentity())
+	appsRoute.GET("/usage", a.GetAppUsage)
+
+	estimateRoute := a.router.Group("/estimate")
+	a.protect(estimateRoute, auth.RequireIdentity())
+	estimateRoute.POST("", a.EstimateCPUHours)
+
+	groupsRoute := a.router.Group("/groups/:name")
+	a.protect(groupsRoute, auth.RequireIdentity())
+	groupsRoute.GET("/summary", a.GetGroupSummary)
+
+	// The administrative endpoints record who made each change, so they're
+	// only available when requests are authenticated.
+	if a.authenticator != nil {
+		adminRoute := a.router.Group("/admin")
+		a.protect(adminRoute, auth.RequireAdmin())
+		adminRoute.POST("/users/:username/cpu-hours/adjustments", a.AdjustCPUHours)
+		adminRoute.GET("/audit", a.GetAuditLog)
+		adminRoute.GET("/export/:kind", a.ExportUsage)
+		adminRoute.GET("/reports/top", a.GetTopConsumers)
+		adminRoute.GET("/reports/efficiency", a.GetReservationEfficiency)
+		adminRoute.POST("/usage-samples", a.AddUsageSamples)
+		adminRoute.PUT("/groups/:name", a.SetGroup)
+		adminRoute.DELETE("/groups/:name", a.DeleteGroup)
+	}
+
 	return a.router
 }
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReportLimit = 10
+	maxReportLimit     = 100
+)
+
+// TopConsumersReport lists the users, apps, and systems that used the most CPU hours during a time window.
+type TopConsumersReport struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	JobType string         `json:"job_type,omitempty"`
+	Users   []db.UsageRank `json:"users"`
+	Apps    []db.UsageRank `json:"apps"`
+	Systems []db.UsageRank `json:"systems"`
+}
+
+// GetTopConsumers is an echo request handler for requests for the users, apps, and systems that used the most CPU
+// hours during a time window, broken out by job type and system. The window defaults to the last 30 days.
+func (a *App) GetTopConsumers(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "top consumers report"}).WithContext(context)
+
+	from, to, err := parseWindow(c)
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseIntParam(c, "limit", defaultReportLimit, 1, maxReportLimit)
+	if err != nil {
+		return err
+	}
+
+	report := &TopConsumersReport{
+		From:    from,
+		To:      to,
+		JobType: c.QueryParam("job_type"),
+	}
+
+	database := db.New(a.database)
+	for _, section := range []struct {
+		dimension db.ReportDimension
+		ranks     *[]db.UsageRank
+	}{
+		{db.ReportByUser, &report.Users},
+		{db.ReportByApp, &report.Apps},
+		{db.ReportBySystem, &report.Systems},
+	} {
+		*section.ranks, err = database.TopConsumers(context, section.dimension, from, to, report.JobType, limit)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	for i := range report.Users {
+		report.Users[i].Name = clients.StripUsernameSuffix(report.Users[i].Name)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
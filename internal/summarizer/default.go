@@ -7,18 +7,27 @@ import (
 
 	"github.com/cyverse-de/resource-usage-api/clients"
 	"github.com/cyverse-de/resource-usage-api/db"
-	"github.com/jmoiron/sqlx"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 )
 
+// CPUUsageLookup looks up a user's CPU usage for the current usage period. *db.Database implements it.
+type CPUUsageLookup interface {
+	CurrentCPUHoursForUser(context context.Context, username string) (*db.CPUHours, error)
+}
+
+// DataUsageLookup looks up a user's data store usage. *clients.DataUsageAPI implements it.
+type DataUsageLookup interface {
+	GetUsageSummary(context context.Context, username string) (*clients.UserDataUsage, error)
+}
+
 type DefaultSummarizer struct {
 	Context         context.Context
 	Log             *logrus.Entry
 	User            string
 	OTelName        string
-	Database        *sqlx.DB
-	DataUsageClient *clients.DataUsageAPI
+	Database        CPUUsageLookup
+	DataUsageClient DataUsageLookup
 }
 
 // loadCPUUsage loads the user's CPU usage information from the DE database.
@@ -28,8 +37,7 @@ func (d *DefaultSummarizer) loadCPUUsage(summary *UserSummary) {
 	ctx, span := otel.Tracer(d.OTelName).Start(d.Context, "summary: CPU hours")
 
 	// Load the CPU usage information from the database.
-	database := db.New(d.Database)
-	cpuHours, err := database.CurrentCPUHoursForUser(ctx, d.User)
+	cpuHours, err := d.Database.CurrentCPUHoursForUser(ctx, d.User)
 	if err == sql.ErrNoRows {
 		cpuHours = &db.CPUHours{}
 		summary.Errors = append(
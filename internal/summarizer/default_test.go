@@ -0,0 +1,95 @@
+package summarizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/fakes"
+	"github.com/cyverse-de/resource-usage-api/logging"
+)
+
+const username = "ipcdev@iplantcollaborative.org"
+
+// failingCPUUsage returns an error for every lookup.
+type failingCPUUsage struct{}
+
+func (failingCPUUsage) CurrentCPUHoursForUser(_ context.Context, _ string) (*db.CPUHours, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newSummarizer(cpuUsage CPUUsageLookup, dataUsage DataUsageLookup) *DefaultSummarizer {
+	return &DefaultSummarizer{
+		Context:         context.Background(),
+		Log:             logging.Log,
+		User:            username,
+		OTelName:        "test",
+		Database:        cpuUsage,
+		DataUsageClient: dataUsage,
+	}
+}
+
+func TestLoadSummary(t *testing.T) {
+	store := fakes.NewStore()
+	store.CPUHours[username] = &db.CPUHours{Username: username, Total: *apd.New(42, 0)}
+
+	dataUsage := fakes.NewDataUsage()
+	dataUsage.Usages[username] = &clients.UserDataUsage{Username: username, Total: 1024}
+
+	summary := newSummarizer(store, dataUsage).LoadSummary()
+
+	if len(summary.Errors) != 0 {
+		t.Fatalf("unexpected errors: %+v", summary.Errors)
+	}
+	if summary.CPUUsage.Total.String() != "42" {
+		t.Errorf("expected 42 CPU hours, got %s", summary.CPUUsage.Total.String())
+	}
+	if summary.DataUsage == nil || summary.DataUsage.Total != 1024 {
+		t.Errorf("expected 1024 bytes of data usage, got %+v", summary.DataUsage)
+	}
+	if summary.Subscription != nil {
+		t.Error("didn't expect subscription information")
+	}
+}
+
+func TestLoadSummaryWithoutUsage(t *testing.T) {
+	summary := newSummarizer(fakes.NewStore(), fakes.NewDataUsage()).LoadSummary()
+
+	if summary.CPUUsage == nil || !summary.CPUUsage.Total.IsZero() {
+		t.Errorf("expected empty CPU usage, got %+v", summary.CPUUsage)
+	}
+	if summary.DataUsage != nil {
+		t.Errorf("didn't expect data usage, got %+v", summary.DataUsage)
+	}
+
+	expected := map[string]int{"cpu_usage": http.StatusNotFound, "data_usage": http.StatusNotFound}
+	if len(summary.Errors) != len(expected) {
+		t.Fatalf("expected %d errors, got %+v", len(expected), summary.Errors)
+	}
+	for _, apiErr := range summary.Errors {
+		if expected[apiErr.Field] != apiErr.ErrorCode {
+			t.Errorf("unexpected error for %s: %+v", apiErr.Field, apiErr)
+		}
+	}
+}
+
+func TestLoadSummaryWithDatabaseError(t *testing.T) {
+	dataUsage := fakes.NewDataUsage()
+	dataUsage.Usages[username] = &clients.UserDataUsage{Username: username}
+
+	summary := newSummarizer(failingCPUUsage{}, dataUsage).LoadSummary()
+
+	if len(summary.Errors) != 1 {
+		t.Fatalf("expected one error, got %+v", summary.Errors)
+	}
+	if summary.Errors[0].Field != "cpu_usage" || summary.Errors[0].ErrorCode != http.StatusInternalServerError {
+		t.Errorf("unexpected error: %+v", summary.Errors[0])
+	}
+	if summary.CPUUsage == nil {
+		t.Error("expected empty CPU usage rather than nil")
+	}
+}
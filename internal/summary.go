@@ -3,6 +3,7 @@ package internal
 import (
 	"net/http"
 
+	"github.com/cyverse-de/resource-usage-api/db"
 	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
@@ -31,7 +32,7 @@ func (a *App) GetUserSummary(c echo.Context) error {
 			Log:             log,
 			User:            a.FixUsername(user),
 			OTelName:        otelName,
-			Database:        a.database,
+			Database:        db.New(a.database),
 			DataUsageClient: a.dataUsageClient,
 		}
 	}
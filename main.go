@@ -1,23 +1,31 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"context"
 
 	"github.com/cyverse-de/messaging/v9"
 	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/auth"
 	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/config"
 	"github.com/cyverse-de/resource-usage-api/cpuhours"
 	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/enforcement"
 	"github.com/cyverse-de/resource-usage-api/internal"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/notifications"
+	"github.com/guregu/null"
 	"github.com/jmoiron/sqlx"
-	"github.com/knadh/koanf"
 	"github.com/sirupsen/logrus"
 
 	"github.com/cyverse-de/go-mod/cfg"
@@ -27,115 +35,236 @@ import (
 	_ "github.com/lib/pq"
 )
 
-const serviceName = "resource-usage-api"
-
 var log = logging.Log.WithFields(logrus.Fields{"package": "main"})
 
-func getHandler(dbClient *sqlx.DB, subscriptions *clients.Subscriptions) amqp.HandlerFn {
-	dedb := db.New(dbClient)
-	cpuhours := cpuhours.New(dedb, subscriptions)
+// shutdownTimeout is how long in-flight HTTP requests are given to finish when the service is stopped.
+const shutdownTimeout = 30 * time.Second
 
-	return func(ctx context.Context, externalID string, state messaging.JobState) {
-		var err error
+// getHandler returns the handler for job updates received over AMQP. Errors are returned so that the update is
+// requeued or quarantined instead of being acknowledged.
+func getHandler(cpuhours *cpuhours.CPUHours) amqp.HandlerFn {
+	return func(ctx context.Context, update *amqp.JobUpdate) error {
+		return handleUpdate(ctx, cpuhours, update)
+	}
+}
 
-		msgLog := log.WithFields(logrus.Fields{"externalID": externalID}).WithContext(ctx)
+// handleUpdate records the state in a job status update and calculates the usage of the step once it has finished.
+// Errors are logged and returned.
+func handleUpdate(ctx context.Context, cpuhours *cpuhours.CPUHours, update *amqp.JobUpdate) error {
+	msgLog := log.WithFields(logrus.Fields{"externalID": update.ExternalID, "state": update.State}).WithContext(ctx)
+
+	switch update.State {
+	case messaging.SubmittedState, messaging.RunningState:
+		msgLog.Debug("recording the analysis state")
+		if err := cpuhours.RecordState(ctx, update.ExternalID, update.State, update.SentOn); err != nil {
+			msgLog.Error(err)
+			return err
+		}
 
-		// TODO: should this happen for non-failed/succeeded messages?
-		if state == messaging.FailedState || state == messaging.SucceededState {
-			msgLog.Debug("calculating CPU hours for analysis")
-			if err = cpuhours.CalculateForAnalysis(ctx, externalID); err != nil {
-				msgLog.Error(err)
-			}
-			msgLog.Debug("done calculating CPU hours for analysis")
-		} else {
-			msgLog.Debugf("received status is %s, ignoring", state)
+	// Canceled analyses consumed resources until they were canceled, so
+	// they're billed the same way as analyses that ran to completion.
+	case messaging.FailedState, messaging.SucceededState, amqp.CanceledState:
+		stateErr := cpuhours.RecordState(ctx, update.ExternalID, update.State, update.SentOn)
+		if stateErr != nil {
+			msgLog.Error(stateErr)
 		}
+
+		msgLog.Debug("calculating CPU hours for analysis")
+		if err := cpuhours.CalculateForAnalysis(ctx, update.ExternalID); err != nil {
+			msgLog.Error(err)
+			return err
+		}
+		msgLog.Debug("done calculating CPU hours for analysis")
+
+		return stateErr
+
+	default:
+		msgLog.Debugf("received status is %s, ignoring", update.State)
 	}
+
+	return nil
+}
+
+// flagKeys maps the command-line flags that can override settings to their configuration keys.
+var flagKeys = map[string]string{
+	"port":                   "listen.port",
+	"queue":                  "amqp.queue",
+	"reconnect":              "amqp.reconnect",
+	"log-level":              "log.level",
+	"usage-routing-key":      "usage.routingkey",
+	"data-usage-base-url":    "datausage.baseurl",
+	"subscriptions-base-uri": "subscriptions.baseuri",
+}
+
+// loadConfig reads the configuration file and environment, applies the flags that were given on the command line,
+// and returns the resulting configuration.
+func loadConfig(configPath, dotEnvPath, envPrefix string) (*config.Config, error) {
+	k, err := cfg.Init(&cfg.Settings{
+		EnvPrefix:   envPrefix,
+		ConfigPath:  configPath,
+		DotEnvPath:  dotEnvPath,
+		StrictMerge: false,
+		FileType:    cfg.YAML,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok && err == nil {
+			err = k.Set(key, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Load(k)
+}
+
+// usageGroups converts the groups defined in the configuration to the form the API uses.
+func usageGroups(groups map[string]config.Group) map[string]*db.UsageGroup {
+	converted := make(map[string]*db.UsageGroup, len(groups))
+	for name, group := range groups {
+		converted[name] = &db.UsageGroup{Name: name, Members: group.Members}
+		if group.Quota > 0 {
+			converted[name].CPUHoursQuota = null.FloatFrom(group.Quota)
+		}
+	}
+	return converted
 }
 
 func main() {
 	var (
 		err    error
-		config *koanf.Koanf
 		dbconn *sqlx.DB
 
-		configPath        = flag.String("config", cfg.DefaultConfigPath, "Full path to the configuration file")
-		dotEnvPath        = flag.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
-		envPrefix         = flag.String("env-prefix", cfg.DefaultEnvPrefix, "The prefix for environment variables")
-		listenPort        = flag.Int("port", 60000, "The port the service listens on for requests")
-		queue             = flag.String("queue", serviceName, "The AMQP queue name for this service")
-		reconnect         = flag.Bool("reconnect", false, "Whether the AMQP client should reconnect on failure")
-		logLevel          = flag.String("log-level", "info", "One of trace, debug, info, warn, error, fatal, or panic.")
-		usageRoutingKey   = flag.String("usage-routing-key", "qms.usages", "The routing key to use when sending usage updates over AMQP")
-		dataUsageBase     = flag.String("data-usage-base-url", "http://data-usage-api", "The base URL for contacting the data-usage-api service")
-		subscriptionsBase = flag.String("subscriptions-base-uri", "http://subscriptions", "The base URL for contacting the subscriptions service")
+		defaults = config.Default()
+
+		configPath = flag.String("config", cfg.DefaultConfigPath, "Full path to the configuration file")
+		dotEnvPath = flag.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
+		envPrefix  = flag.String("env-prefix", cfg.DefaultEnvPrefix, "The prefix for environment variables")
+		logLevel   = flag.String("log-level", defaults.Log.Level, "One of trace, debug, info, warn, error, fatal, or panic. Overrides log.level")
 	)
 
+	flag.Int("port", defaults.Listen.Port, "The port the service listens on for requests. Overrides listen.port")
+	flag.String("queue", defaults.AMQP.Queue, "The AMQP queue name for this service. Overrides amqp.queue")
+	flag.Bool("reconnect", defaults.AMQP.Reconnect, "Whether the AMQP client should reconnect on failure. Overrides amqp.reconnect")
+	flag.String("usage-routing-key", defaults.Usage.RoutingKey, "The routing key to use when sending usage events over AMQP. Set to an empty string to disable usage events. Overrides usage.routingkey")
+	flag.String("data-usage-base-url", defaults.DataUsage.BaseURL, "The base URL for contacting the data-usage-api service. Overrides datausage.baseurl")
+	flag.String("subscriptions-base-uri", defaults.Subscriptions.BaseURI, "The base URL for contacting the subscriptions service. Overrides subscriptions.baseuri")
+
 	flag.Parse()
 
 	logging.SetupLogging(*logLevel)
 
 	log.Infof("config path is %s", *configPath)
-	log.Infof("listen port is %d", *listenPort)
 	log.Infof("dotenv file is %s", *dotEnvPath)
-	log.Infof("subscriptions base URI is %s", *subscriptionsBase)
 
-	config, err = cfg.Init(&cfg.Settings{
-		EnvPrefix:   *envPrefix,
-		ConfigPath:  *configPath,
-		DotEnvPath:  *dotEnvPath,
-		StrictMerge: false,
-		FileType:    cfg.YAML,
-	})
+	conf, err := loadConfig(*configPath, *dotEnvPath, *envPrefix)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Infof("done reading configuration from %s", *configPath)
 
-	dbURI := config.String("db.uri")
-	if dbURI == "" {
-		log.Fatal("db.uri must be set in the configuration file")
+	validationErr := conf.Validate()
+
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "print" {
+			log.Fatalf("unknown config subcommand %q", flag.Arg(1))
+		}
+		if err = conf.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if validationErr != nil {
+			fmt.Fprintf(os.Stderr, "the configuration is invalid:\n%s\n", validationErr)
+			os.Exit(1)
+		}
+		return
 	}
 
-	amqpURI := config.String("amqp.uri")
-	if amqpURI == "" {
-		log.Fatal("amqp.uri must be set in the configuration file")
+	if validationErr != nil {
+		log.Fatalf("the configuration is invalid:\n%s", validationErr)
 	}
 
-	amqpExchange := config.String("amqp.exchange.name")
-	if amqpExchange == "" {
-		log.Fatal("amqp.exchange.name must be set in the configuration file")
+	logging.SetupLogging(conf.Log.Level)
+
+	log.Infof("listen port is %d", conf.Listen.Port)
+	log.Infof("subscriptions base URI is %s", conf.Subscriptions.BaseURI)
+
+	dbSettings := &db.ConnectionSettings{
+		MaxOpenConns:     conf.DB.Pool.MaxOpen,
+		MaxIdleConns:     conf.DB.Pool.MaxIdle,
+		ConnMaxLifetime:  conf.DB.Pool.MaxLifetime,
+		ConnMaxIdleTime:  conf.DB.Pool.MaxIdleTime,
+		StatementTimeout: conf.DB.StatementTimeout,
+		TimeZone:         conf.DB.TimeZone,
+		ConnectTimeout:   conf.DB.Connect.Timeout,
+		InitialBackoff:   conf.DB.Connect.InitialBackoff,
+		MaxBackoff:       conf.DB.Connect.MaxBackoff,
+	}
+
+	log.Infof(
+		"database pool: %d max open, %d max idle, %s max lifetime, %s max idle time; statement timeout: %s",
+		dbSettings.MaxOpenConns,
+		dbSettings.MaxIdleConns,
+		dbSettings.ConnMaxLifetime,
+		dbSettings.ConnMaxIdleTime,
+		dbSettings.StatementTimeout,
+	)
+
+	dbconn, err = db.Connect(context.Background(), conf.DB.URI, dbSettings)
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Info("done connecting to the database")
 
-	amqpExchangeType := config.String("amqp.exchange.type")
-	if amqpExchangeType == "" {
-		log.Fatal("amqp.exchange.type must be set in the configuration file")
+	timeZone, err := db.New(dbconn).SessionTimeZone(context.Background())
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Infof("timestamps without time zones in the database are in %s", timeZone)
 
-	userSuffix := config.String("users.domain")
-	if userSuffix == "" {
-		log.Fatal("users.domain must be set in the configuration file")
+	if flag.Arg(0) == "migrate" {
+		if err = runMigrate(context.Background(), flag.Args()[1:], db.New(dbconn)); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	qmsEnabled := config.Bool("qms.enabled")
+	// Refuse to run against a schema that's missing migrations. Migrations from a newer version are only logged.
+	if err = db.New(dbconn).CheckSchemaVersion(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
-	dbconn = sqlx.MustConnect("postgres", dbURI)
-	log.Info("done connecting to the database")
-	dbconn.SetMaxOpenConns(10)
-	dbconn.SetConnMaxIdleTime(time.Minute)
+	switch flag.Arg(0) {
+	case "export":
+		if err = runExport(context.Background(), flag.Args()[1:], db.New(dbconn)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "import-samples":
+		if err = runImportSamples(context.Background(), flag.Args()[1:], db.New(dbconn)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	subscriptionsClient, err := clients.SubscriptionsClient(*subscriptionsBase)
+	subscriptionsClient, err := clients.SubscriptionsClient(conf.Subscriptions.BaseURI)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	amqpConfig := amqp.Configuration{
-		URI:           amqpURI,
-		Exchange:      amqpExchange,
-		ExchangeType:  amqpExchangeType,
-		Reconnect:     *reconnect,
-		Queue:         *queue,
-		PrefetchCount: 10,
+		URI:           conf.AMQP.URI,
+		Exchange:      conf.AMQP.Exchange.Name,
+		ExchangeType:  conf.AMQP.Exchange.Type,
+		Reconnect:     conf.AMQP.Reconnect,
+		Queue:         conf.AMQP.Queue,
+		PrefetchCount: conf.AMQP.Prefetch,
+		Workers:       conf.AMQP.Workers,
+		QueueDepth:    conf.AMQP.QueueDepth,
+		QuarantineKey: conf.AMQP.QuarantineKey,
 	}
 
 	log.Infof("AMQP exchange name: %s", amqpConfig.Exchange)
@@ -143,23 +272,124 @@ func main() {
 	log.Infof("AMQP reconnect: %v", amqpConfig.Reconnect)
 	log.Infof("AMQP queue name: %s", amqpConfig.Queue)
 	log.Infof("AMQP prefetch amount %d", amqpConfig.PrefetchCount)
+	log.Infof("AMQP workers: %d; queue depth per worker: %d", amqpConfig.Workers, amqpConfig.QueueDepth)
+	log.Infof("AMQP quarantine queue: %s", amqpConfig.QuarantineKey)
 
-	amqpClient, err := amqp.New(&amqpConfig, getHandler(dbconn, subscriptionsClient))
+	amqpClient, err := amqp.New(&amqpConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer amqpClient.Close()
-	log.Debug("after close")
 
 	log.Info("done connecting to the AMQP broker")
 
+	cpuHours := cpuhours.New(cpuhours.DatabaseStore(db.New(dbconn)), subscriptionsClient)
+
+	// Quota thresholds come from the subscriptions service, so notifications
+	// only make sense when QMS is enabled.
+	if conf.Notifications.Enabled && conf.QMS.Enabled {
+		log.Infof("quota notification thresholds: %v", conf.Notifications.Thresholds)
+		notifier := notifications.NewQuotaNotifier(db.New(dbconn), subscriptionsClient, amqpClient, conf.Notifications.Thresholds)
+		cpuHours.AddHook(func(ctx context.Context, username string, _ *cpuhours.CalculationResult) error {
+			return notifier.CheckThresholds(ctx, username, clients.ResourceTypeCPUHours)
+		})
+	}
+
+	// Like notifications, enforcement relies on the quotas in the subscriptions
+	// service.
+	var enforcer *enforcement.Enforcer
+	if conf.Enforcement.Enabled && conf.QMS.Enabled {
+		var signaller enforcement.Signaller
+		if conf.Enforcement.Endpoint != "" {
+			log.Infof("sending over-quota events to %s", conf.Enforcement.Endpoint)
+			signaller = &enforcement.HTTPSignaller{URL: conf.Enforcement.Endpoint}
+		} else {
+			log.Infof("publishing over-quota events with the routing key %s", conf.Enforcement.RoutingKey)
+			signaller = &enforcement.AMQPSignaller{Publisher: amqpClient, RoutingKey: conf.Enforcement.RoutingKey}
+		}
+		log.Infof("quota enforcement grace period: %s; exempt plans: %v", conf.Enforcement.GracePeriod, conf.Enforcement.ExemptPlans)
+
+		enforcer = enforcement.New(db.New(dbconn), subscriptionsClient, signaller, conf.Enforcement.GracePeriod, conf.Enforcement.ExemptPlans)
+		cpuHours.AddHook(func(ctx context.Context, username string, res *cpuhours.CalculationResult) error {
+			return enforcer.Check(ctx, username, res.Analysis.UserID, clients.ResourceTypeCPUHours)
+		})
+	}
+
+	if conf.Usage.RoutingKey != "" {
+		log.Infof("publishing usage events with the routing key %s", conf.Usage.RoutingKey)
+		cpuHours.AddHook(func(ctx context.Context, username string, res *cpuhours.CalculationResult) error {
+			event, err := res.UsageEvent(username)
+			if err != nil {
+				return err
+			}
+			return amqpClient.PublishUsageEvent(ctx, conf.Usage.RoutingKey, event)
+		})
+	}
+
+	if flag.Arg(0) == "replay" {
+		err = runReplay(context.Background(), flag.Args()[1:], cpuHours, conf.AMQP.URI)
+		amqpClient.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The background workers and the HTTP server are stopped when the service is asked to shut down.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	finalizer := cpuhours.NewFinalizer(
+		cpuHours,
+		conf.Finalization.Interval,
+		conf.Finalization.RetryDelay,
+		conf.Finalization.MaxAttempts,
+		conf.Finalization.BatchSize,
+	)
+	go finalizer.Run(ctx)
+
+	if enforcer != nil {
+		log.Infof("sweeping quota overages every %s", conf.Enforcement.SweepInterval)
+		go enforcer.Run(ctx, conf.Enforcement.SweepInterval)
+	}
+
+	if err = amqpClient.Consume(getHandler(cpuHours)); err != nil {
+		log.Fatal(err)
+	}
+
+	var authenticator auth.Authenticator
+	if conf.Auth.Enabled {
+		var keys *auth.KeySet
+		if conf.Auth.JWKSFile != "" {
+			log.Infof("reading token signing keys from %s", conf.Auth.JWKSFile)
+			keys, err = auth.LoadKeySetFile(conf.Auth.JWKSFile)
+		} else {
+			log.Infof("fetching token signing keys from %s", conf.Auth.JWKSURL)
+			keys, err = auth.NewRemoteKeySet(context.Background(), conf.Auth.JWKSURL)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		authenticator = auth.NewJWTAuthenticator(keys, auth.JWTSettings{
+			Issuer:        conf.Auth.Issuer,
+			Audience:      conf.Auth.Audience,
+			UsernameClaim: conf.Auth.UsernameClaim,
+			AdminRole:     conf.Auth.AdminRole,
+		})
+	} else {
+		log.Warn("authentication is disabled; anyone can query any user's usage")
+	}
+
 	appConfig := &internal.AppConfiguration{
-		UserSuffix:           userSuffix,
-		DataUsageBaseURL:     *dataUsageBase,
+		UserSuffix:           conf.Users.Domain,
+		DataUsageBaseURL:     conf.DataUsage.BaseURL,
 		AMQPClient:           amqpClient,
-		AMQPUsageRoutingKey:  *usageRoutingKey,
-		QMSEnabled:           qmsEnabled,
-		SubscriptionsBaseURI: *subscriptionsBase,
+		AMQPUsageRoutingKey:  conf.Usage.RoutingKey,
+		QMSEnabled:           conf.QMS.Enabled,
+		SubscriptionsBaseURI: conf.Subscriptions.BaseURI,
+		Authenticator:        authenticator,
+		CPUHours:             cpuHours,
+		Groups:               usageGroups(conf.Groups),
 	}
 
 	app, err := internal.New(dbconn, appConfig)
@@ -167,6 +397,38 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Infof("listening on port %d", *listenPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.Router()))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", strconv.Itoa(conf.Listen.Port)),
+		Handler: app.Router(),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Infof("listening on port %d", conf.Listen.Port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	var serveErr error
+	select {
+	case serveErr = <-serverErr:
+		log.WithError(serveErr).Error("the HTTP server stopped unexpectedly")
+	case <-ctx.Done():
+		log.Info("shutting down")
+	}
+	stop()
+
+	// Stop accepting requests first, then stop consuming job updates and wait for the ones that were already
+	// received to be handled and acknowledged.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Error("unable to shut down the HTTP server")
+	}
+
+	amqpClient.Close()
+	log.Info("done shutting down")
+
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
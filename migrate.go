@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// printMigrationStatuses writes a table describing whether each migration has been applied.
+func printMigrationStatuses(w io.Writer, statuses []db.MigrationStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED") // nolint: errcheck
+
+	for _, status := range statuses {
+		applied := "pending"
+		switch {
+		case status.Unknown:
+			applied = fmt.Sprintf("%s (unknown to this version)", status.AppliedAt.Time.UTC().Format(time.RFC3339))
+		case status.AppliedAt.Valid:
+			applied = status.AppliedAt.Time.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%06d\t%s\t%s\n", status.Version, status.Name, applied) // nolint: errcheck
+	}
+
+	return tw.Flush()
+}
+
+// runMigrate runs the migrate subcommand, which applies, reverts, or lists the database migrations embedded in the
+// service.
+func runMigrate(ctx context.Context, args []string, database *db.Database) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(ctx)
+		log.Infof("applied %d migrations", len(applied))
+		return err
+
+	case "down":
+		var steps int
+
+		flags := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		flags.IntVar(&steps, "steps", 1, "The number of migrations to revert")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if steps < 1 {
+			return errors.New("--steps must be at least 1")
+		}
+
+		reverted, err := database.MigrateDown(ctx, steps)
+		log.Infof("reverted %d migrations", len(reverted))
+		return err
+
+	case "status":
+		statuses, err := database.MigrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		return printMigrationStatuses(os.Stdout, statuses)
+
+	default:
+		return fmt.Errorf("unknown migrate command %q: expected up, down, or status", args[0])
+	}
+}
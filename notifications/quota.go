@@ -0,0 +1,166 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "notifications"})
+
+// NotificationType is the notification type used for quota threshold notifications.
+const NotificationType = "usage"
+
+// EmailTemplate is the name of the email template the notification agent uses for quota threshold notifications.
+const EmailTemplate = "quota_threshold"
+
+// Publisher sends notifications to users.
+type Publisher interface {
+	PublishNotification(context context.Context, msg *messaging.NotificationMessage) error
+}
+
+// NotificationStore records which threshold notifications have been sent.
+type NotificationStore interface {
+	RecordQuotaNotification(context context.Context, subscriptionID, resourceType string, threshold float64) (bool, error)
+	DeleteQuotaNotification(context context.Context, subscriptionID, resourceType string, threshold float64) error
+}
+
+// SubscriptionLookup looks up users' current subscriptions.
+type SubscriptionLookup interface {
+	GetUserSubscription(context context.Context, username string) (*qms.Subscription, error)
+}
+
+// QuotaNotifier sends a notification to a user when their usage of a resource crosses one of the configured
+// percentages of their quota. Each threshold is only sent once per subscription period.
+type QuotaNotifier struct {
+	store         NotificationStore
+	subscriptions SubscriptionLookup
+	publisher     Publisher
+	thresholds    []float64
+}
+
+// NewQuotaNotifier returns a new *QuotaNotifier. The thresholds are percentages of the quota, e.g. 75, 90, 100.
+func NewQuotaNotifier(store NotificationStore, subscriptions SubscriptionLookup, publisher Publisher, thresholds []float64) *QuotaNotifier {
+	sorted := make([]float64, len(thresholds))
+	copy(sorted, thresholds)
+	sort.Float64s(sorted)
+
+	return &QuotaNotifier{
+		store:         store,
+		subscriptions: subscriptions,
+		publisher:     publisher,
+		thresholds:    sorted,
+	}
+}
+
+// crossedThresholds returns the configured thresholds at or below the given percentage, in ascending order.
+func (n *QuotaNotifier) crossedThresholds(percent float64) []float64 {
+	var crossed []float64
+	for _, threshold := range n.thresholds {
+		if percent >= threshold {
+			crossed = append(crossed, threshold)
+		}
+	}
+	return crossed
+}
+
+func (n *QuotaNotifier) notification(username string, subscription *qms.Subscription, resourceType string, threshold, quota, usage float64) *messaging.NotificationMessage {
+	subject := fmt.Sprintf("You have used %s%% of your %s quota", strconv.FormatFloat(threshold, 'f', -1, 64), resourceType)
+
+	return &messaging.NotificationMessage{
+		Email:         true,
+		EmailTemplate: EmailTemplate,
+		Message: map[string]interface{}{
+			"timestamp": strconv.FormatInt(time.Now().UnixMilli(), 10),
+			"text":      subject,
+		},
+		Payload: map[string]interface{}{
+			"username":             clients.StripUsernameSuffix(username),
+			"subscription_id":      subscription.GetUuid(),
+			"plan_name":            subscription.GetPlan().GetName(),
+			"resource_type":        resourceType,
+			"threshold":            threshold,
+			"quota":                quota,
+			"usage":                usage,
+			"effective_start_date": subscription.GetEffectiveStartDate().AsTime(),
+			"effective_end_date":   subscription.GetEffectiveEndDate().AsTime(),
+		},
+		Subject: subject,
+		Type:    NotificationType,
+		User:    clients.StripUsernameSuffix(username),
+	}
+}
+
+// CheckThresholds looks up the user's current subscription and sends a notification if their usage of the resource
+// type has crossed a threshold that hasn't been notified about during the current subscription period. If several
+// thresholds were crossed at once, only the highest one is sent, but all of them are marked as sent.
+func (n *QuotaNotifier) CheckThresholds(context context.Context, username, resourceType string) error {
+	msgLog := log.WithFields(logrus.Fields{"context": "checking quota thresholds", "user": username}).WithContext(context)
+
+	if len(n.thresholds) == 0 {
+		return nil
+	}
+
+	subscription, err := n.subscriptions.GetUserSubscription(context, username)
+	if err != nil {
+		return err
+	}
+
+	quota, usage, found := clients.QuotaAndUsage(subscription, resourceType)
+	if !found || quota <= 0 {
+		msgLog.Debugf("no %s quota found, skipping threshold checks", resourceType)
+		return nil
+	}
+
+	percent := usage / quota * 100
+	msgLog.Debugf("%s usage is %f of %f (%f%%)", resourceType, usage, quota, percent)
+
+	crossed := n.crossedThresholds(percent)
+	if len(crossed) == 0 {
+		return nil
+	}
+
+	// Record every crossed threshold, keeping track of the highest one that hasn't been sent yet.
+	var (
+		highest    float64
+		newlySent  []float64
+		sendNeeded bool
+	)
+	for _, threshold := range crossed {
+		recorded, err := n.store.RecordQuotaNotification(context, subscription.GetUuid(), resourceType, threshold)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			highest = threshold
+			newlySent = append(newlySent, threshold)
+			sendNeeded = true
+		}
+	}
+
+	if !sendNeeded {
+		return nil
+	}
+
+	msgLog.Infof("sending the %f%% %s threshold notification", highest, resourceType)
+	msg := n.notification(username, subscription, resourceType, highest, quota, usage)
+	if err = n.publisher.PublishNotification(context, msg); err != nil {
+		// Forget the thresholds so that they're retried on the next usage update.
+		for _, threshold := range newlySent {
+			if deleteErr := n.store.DeleteQuotaNotification(context, subscription.GetUuid(), resourceType, threshold); deleteErr != nil {
+				msgLog.WithError(deleteErr).Error("unable to remove the quota notification record")
+			}
+		}
+		return err
+	}
+
+	return nil
+}
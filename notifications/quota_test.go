@@ -0,0 +1,186 @@
+package notifications_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/fakes"
+	"github.com/cyverse-de/resource-usage-api/notifications"
+)
+
+const (
+	username       = "ipcdev@iplantcollaborative.org"
+	subscriptionID = "subscription-1"
+	resourceType   = "cpu.hours"
+)
+
+// publisher records the notifications that are published, failing instead when err is set.
+type publisher struct {
+	err  error
+	sent []*messaging.NotificationMessage
+}
+
+func (p *publisher) PublishNotification(_ context.Context, msg *messaging.NotificationMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.sent = append(p.sent, msg)
+	return nil
+}
+
+// setup returns a notifier for a user with a quota of 100 CPU hours, of which they've used the given amount.
+func setup(usage float64) (*fakes.QuotaStore, *fakes.QMS, *publisher, *notifications.QuotaNotifier) {
+	cpuHours := &qms.ResourceType{Name: resourceType, Unit: "cpu hours"}
+
+	qmsClient := fakes.NewQMS()
+	qmsClient.Subscriptions["ipcdev"] = &qms.Subscription{
+		Uuid:   subscriptionID,
+		Quotas: []*qms.Quota{{ResourceType: cpuHours, Quota: 100}},
+		Usages: []*qms.Usage{{ResourceType: cpuHours, Usage: usage}},
+	}
+
+	store := fakes.NewQuotaStore()
+	pub := &publisher{}
+	return store, qmsClient, pub, notifications.NewQuotaNotifier(store, qmsClient, pub, []float64{100, 75, 90})
+}
+
+func setUsage(qmsClient *fakes.QMS, usage float64) {
+	qmsClient.Subscriptions["ipcdev"].Usages[0].Usage = usage
+}
+
+func sentThresholds(pub *publisher) []float64 {
+	var thresholds []float64
+	for _, msg := range pub.sent {
+		thresholds = append(thresholds, msg.Payload.(map[string]interface{})["threshold"].(float64))
+	}
+	return thresholds
+}
+
+func TestCheckThresholdsBelowThreshold(t *testing.T) {
+	store, _, pub, notifier := setup(50)
+
+	if err := notifier.CheckThresholds(context.Background(), username, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(pub.sent) != 0 {
+		t.Errorf("expected no notifications, got %v", sentThresholds(pub))
+	}
+	if len(store.Notifications) != 0 {
+		t.Errorf("expected no recorded notifications, got %+v", store.Notifications)
+	}
+}
+
+func TestCheckThresholdsCrossing(t *testing.T) {
+	_, qmsClient, pub, notifier := setup(50)
+	context := context.Background()
+
+	for _, usage := range []float64{74, 75, 80, 95, 120} {
+		setUsage(qmsClient, usage)
+		if err := notifier.CheckThresholds(context, username, resourceType); err != nil {
+			t.Fatalf("unexpected error at %f hours: %s", usage, err)
+		}
+	}
+
+	thresholds := sentThresholds(pub)
+	if len(thresholds) != 3 || thresholds[0] != 75 || thresholds[1] != 90 || thresholds[2] != 100 {
+		t.Errorf("expected the 75, 90 and 100 thresholds to be sent once each, got %v", thresholds)
+	}
+
+	msg := pub.sent[0]
+	if msg.User != "ipcdev" || msg.Type != notifications.NotificationType || msg.EmailTemplate != notifications.EmailTemplate {
+		t.Errorf("unexpected notification: %+v", msg)
+	}
+}
+
+func TestCheckThresholdsSendsHighestCrossed(t *testing.T) {
+	store, _, pub, notifier := setup(95)
+
+	if err := notifier.CheckThresholds(context.Background(), username, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if thresholds := sentThresholds(pub); len(thresholds) != 1 || thresholds[0] != 90 {
+		t.Errorf("expected only the 90%% threshold to be sent, got %v", thresholds)
+	}
+
+	for _, threshold := range []float64{75, 90} {
+		key := fakes.QuotaNotification{SubscriptionID: subscriptionID, ResourceType: resourceType, Threshold: threshold}
+		if !store.Notifications[key] {
+			t.Errorf("expected the %f%% threshold to be recorded", threshold)
+		}
+	}
+}
+
+func TestCheckThresholdsDedup(t *testing.T) {
+	store, _, pub, notifier := setup(80)
+	context := context.Background()
+
+	// A notification recorded by another instance shouldn't be sent again.
+	if _, err := store.RecordQuotaNotification(context, subscriptionID, resourceType, 75); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := notifier.CheckThresholds(context, username, resourceType); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(pub.sent) != 0 {
+		t.Errorf("expected no notifications, got %v", sentThresholds(pub))
+	}
+}
+
+func TestCheckThresholdsNewSubscriptionPeriod(t *testing.T) {
+	_, qmsClient, pub, notifier := setup(80)
+	context := context.Background()
+
+	if err := notifier.CheckThresholds(context, username, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The notifications are recorded per subscription, so a renewed subscription starts over.
+	qmsClient.Subscriptions["ipcdev"].Uuid = "subscription-2"
+	if err := notifier.CheckThresholds(context, username, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if thresholds := sentThresholds(pub); len(thresholds) != 2 {
+		t.Errorf("expected the 75%% threshold to be sent for each subscription, got %v", thresholds)
+	}
+}
+
+func TestCheckThresholdsPublishFailure(t *testing.T) {
+	store, _, pub, notifier := setup(80)
+	context := context.Background()
+
+	pub.err = errors.New("broker unavailable")
+	if err := notifier.CheckThresholds(context, username, resourceType); err == nil {
+		t.Fatal("expected the publish error to be returned")
+	}
+	if len(store.Notifications) != 0 {
+		t.Errorf("expected the failed notification to be forgotten, got %+v", store.Notifications)
+	}
+
+	pub.err = nil
+	if err := notifier.CheckThresholds(context, username, resourceType); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if thresholds := sentThresholds(pub); len(thresholds) != 1 || thresholds[0] != 75 {
+		t.Errorf("expected the 75%% threshold to be sent on retry, got %v", thresholds)
+	}
+}
+
+func TestCheckThresholdsNoQuota(t *testing.T) {
+	_, _, pub, notifier := setup(80)
+
+	if err := notifier.CheckThresholds(context.Background(), username, "data.size"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(pub.sent) != 0 {
+		t.Errorf("expected no notifications, got %v", sentThresholds(pub))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	streadway "github.com/streadway/amqp"
+)
+
+// The largest message that can be read from a replay file.
+const maxReplayLineSize = 1024 * 1024
+
+// replayOptions contains the settings for the replay subcommand.
+type replayOptions struct {
+	file   string
+	queue  string
+	dryRun bool
+}
+
+// parseReplayOptions parses the arguments to the replay subcommand.
+func parseReplayOptions(args []string) (*replayOptions, error) {
+	var opts replayOptions
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.StringVar(&opts.file, "file", "", "A file containing one job update message per line")
+	flags.StringVar(&opts.queue, "queue", "", "An AMQP queue, such as a dead-letter queue, to read job update messages from")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Show what each message would charge without recording anything")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if (opts.file == "") == (opts.queue == "") {
+		return nil, errors.New("exactly one of --file or --queue must be given")
+	}
+
+	return &opts, nil
+}
+
+// replayHandler handles a replayed job update, returning an error if it
+// couldn't be handled.
+type replayHandler func(ctx context.Context, update *amqp.JobUpdate) error
+
+// dryRunHandler returns a handler that writes what each job update would
+// charge to out without recording anything.
+func dryRunHandler(cpuHours *cpuhours.CPUHours, out io.Writer) replayHandler {
+	return func(ctx context.Context, update *amqp.JobUpdate) error {
+		switch update.State {
+		case messaging.FailedState, messaging.SucceededState, amqp.CanceledState:
+			res, err := cpuHours.Preview(ctx, update.ExternalID)
+			switch {
+			case errors.Is(err, cpuhours.ErrEndDateMissing):
+				fmt.Fprintf(out, "%s\t%s\tdeferred: the step has no end date\n", update.ExternalID, update.State)
+			case err != nil:
+				fmt.Fprintf(out, "%s\t%s\terror: %s\n", update.ExternalID, update.State, err)
+				return err
+			case res.CPUHours.IsZero():
+				fmt.Fprintf(out, "%s\t%s\tnothing to charge: already charged up to %s\n", update.ExternalID, update.State, res.CalcTime.Format(time.RFC3339))
+			default:
+				fmt.Fprintf(
+					out,
+					"%s\t%s\t%s cpu hours\tanalysis %s step %d from %s to %s\n",
+					update.ExternalID,
+					update.State,
+					res.CPUHours.String(),
+					res.Analysis.ID,
+					res.Step.StepNumber,
+					res.BasisTime.Format(time.RFC3339),
+					res.CalcTime.Format(time.RFC3339),
+				)
+			}
+
+		default:
+			fmt.Fprintf(out, "%s\t%s\tno charge\n", update.ExternalID, update.State)
+		}
+
+		return nil
+	}
+}
+
+// errUndecodable is returned for stored messages that can't be decoded as job updates.
+var errUndecodable = errors.New("the job update couldn't be decoded")
+
+// replayer decodes stored job update messages and passes them to a handler.
+type replayer struct {
+	handler  replayHandler
+	replayed int
+	skipped  int
+	failed   int
+}
+
+// replay decodes a single message and passes it to the handler. An error is
+// returned if the message couldn't be decoded or handled.
+func (r *replayer) replay(ctx context.Context, body []byte) error {
+	update, err := amqp.DecodeJobUpdate(body)
+	if err != nil {
+		log.WithError(err).Warn("skipping job update")
+		r.skipped++
+		return fmt.Errorf("%w: %s", errUndecodable, err)
+	}
+
+	if err = r.handler(ctx, update); err != nil {
+		r.failed++
+		return err
+	}
+
+	r.replayed++
+	return nil
+}
+
+// replayFile replays each of the non-empty lines in a file as a job update.
+func (r *replayer) replayFile(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLineSize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		_ = r.replay(ctx, scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
+
+// replayQueue replays every message waiting in an AMQP queue. Each message is
+// removed from the queue once it has been handled. Messages that couldn't be
+// decoded or handled are left on the queue, as is every message in a dry run.
+// They're returned to the queue once all of the messages have been read, so
+// that each one is only read once.
+func (r *replayer) replayQueue(ctx context.Context, uri, queue string, dryRun bool) error {
+	conn, err := streadway.Dial(uri)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint: errcheck
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close() // nolint: errcheck
+
+	var lastUnacked uint64
+	for {
+		delivery, ok, err := channel.Get(queue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if err = r.replay(ctx, delivery.Body); err != nil || dryRun {
+			lastUnacked = delivery.DeliveryTag
+		} else if err = delivery.Ack(false); err != nil {
+			return err
+		}
+	}
+
+	// Acknowledged messages aren't affected by a multiple nack.
+	if lastUnacked != 0 {
+		return channel.Nack(lastUnacked, true, true)
+	}
+
+	return nil
+}
+
+// runReplay runs the replay subcommand.
+func runReplay(ctx context.Context, args []string, cpuHours *cpuhours.CPUHours, amqpURI string) error {
+	opts, err := parseReplayOptions(args)
+	if err != nil {
+		return err
+	}
+
+	recalculation := cpuHours.WithAuditSource(db.AuditSourceRecalculation)
+	r := &replayer{handler: func(ctx context.Context, update *amqp.JobUpdate) error {
+		return handleUpdate(ctx, recalculation, update)
+	}}
+	if opts.dryRun {
+		r.handler = dryRunHandler(cpuHours, os.Stdout)
+	}
+
+	if opts.file != "" {
+		err = r.replayFile(ctx, opts.file)
+	} else {
+		err = r.replayQueue(ctx, amqpURI, opts.queue, opts.dryRun)
+	}
+
+	log.Infof("replayed %d job updates; skipped %d; failed %d", r.replayed, r.skipped, r.failed)
+
+	if err == nil && r.skipped+r.failed > 0 {
+		err = fmt.Errorf("%d job updates couldn't be replayed", r.skipped+r.failed)
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/samples"
+)
+
+// runImportSamples runs the import-samples subcommand, which records the CPU usage samples in a metrics export file.
+func runImportSamples(ctx context.Context, args []string, database *db.Database) error {
+	var path, formatName string
+
+	flags := flag.NewFlagSet("import-samples", flag.ContinueOnError)
+	flags.StringVar(&path, "file", "", "The file containing the samples")
+	flags.StringVar(&formatName, "format", string(samples.FormatCSV), "The format of the file: csv, json, or jsonl")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.New("--file is required")
+	}
+
+	format, err := samples.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+
+	count, err := samples.Import(ctx, database, f, format)
+	log.Infof("imported %d samples from %s", count, path)
+	return err
+}
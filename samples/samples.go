@@ -0,0 +1,228 @@
+// Package samples reads CPU usage samples exported from the metrics system.
+package samples
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// Format is the format of a file of samples.
+type Format string
+
+const (
+	// FormatCSV is a CSV file with a header row naming the analysis_id, sampled_at, and millicores_used columns.
+	FormatCSV Format = "csv"
+
+	// FormatJSON is a JSON array of sample objects.
+	FormatJSON Format = "json"
+
+	// FormatJSONL is a file containing one JSON sample object per line.
+	FormatJSONL Format = "jsonl"
+)
+
+// The number of samples passed to the callback at a time.
+const batchSize = 500
+
+// The largest line that can be read from a JSON Lines file.
+const maxLineSize = 1024 * 1024
+
+// ErrInvalid is returned when the samples can't be read or one of them is invalid, as opposed to when they can't be
+// recorded.
+var ErrInvalid = errors.New("invalid samples")
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case FormatCSV, FormatJSON, FormatJSONL:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unsupported sample format %q; must be csv, json, or jsonl", name)
+}
+
+// validate checks that a sample has all of its fields.
+func validate(sample *db.UsageSample) error {
+	switch {
+	case sample.AnalysisID == "":
+		return errors.New("analysis_id is required")
+	case sample.SampledAt.IsZero():
+		return errors.New("sampled_at is required")
+	case sample.MillicoresUsed < 0:
+		return errors.New("millicores_used must not be negative")
+	}
+	return nil
+}
+
+// batcher collects samples and passes them to a callback in batches. The count only includes the samples in batches
+// that the callback accepted, and fnErr is the error returned by the callback if it failed.
+type batcher struct {
+	batch []db.UsageSample
+	fn    func([]db.UsageSample) error
+	count int
+	fnErr error
+}
+
+func (b *batcher) add(record int, sample db.UsageSample) error {
+	if err := validate(&sample); err != nil {
+		return fmt.Errorf("sample %d: %w", record, err)
+	}
+
+	b.batch = append(b.batch, sample)
+	if len(b.batch) >= batchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	err := b.fn(b.batch)
+	if err == nil {
+		b.count += len(b.batch)
+	} else {
+		b.fnErr = err
+	}
+	b.batch = b.batch[:0]
+	return err
+}
+
+// Read reads samples in the given format, passing them to fn in batches. It returns the number of samples in the
+// batches that fn accepted, which doesn't include the samples read since the last batch if an error occurs. Errors
+// returned by fn are returned as they are, and every other error wraps ErrInvalid.
+func Read(r io.Reader, format Format, fn func([]db.UsageSample) error) (int, error) {
+	var err error
+
+	b := &batcher{fn: fn}
+
+	switch format {
+	case FormatCSV:
+		err = readCSV(r, b)
+	case FormatJSON:
+		err = readJSON(r, b)
+	case FormatJSONL:
+		err = readJSONL(r, b)
+	default:
+		err = fmt.Errorf("unsupported sample format %q", format)
+	}
+	if err != nil {
+		if b.fnErr == nil {
+			err = fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+		return b.count, err
+	}
+
+	return b.count, b.flush()
+}
+
+func readCSV(r io.Reader, b *batcher) error {
+	reader := csv.NewReader(r)
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("unable to read the header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"analysis_id", "sampled_at", "millicores_used"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("the %s column is missing", name)
+		}
+	}
+
+	for record := 1; ; record++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		sampledAt, err := time.Parse(time.RFC3339, row[columns["sampled_at"]])
+		if err != nil {
+			return fmt.Errorf("sample %d: invalid sampled_at: %w", record, err)
+		}
+		used, err := strconv.ParseFloat(row[columns["millicores_used"]], 64)
+		if err != nil {
+			return fmt.Errorf("sample %d: invalid millicores_used: %w", record, err)
+		}
+
+		sample := db.UsageSample{
+			AnalysisID:     row[columns["analysis_id"]],
+			SampledAt:      sampledAt,
+			MillicoresUsed: used,
+		}
+		if err = b.add(record, sample); err != nil {
+			return err
+		}
+	}
+}
+
+func readJSON(r io.Reader, b *batcher) error {
+	decoder := json.NewDecoder(r)
+
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("expected a JSON array: %w", err)
+	}
+
+	for record := 1; decoder.More(); record++ {
+		var sample db.UsageSample
+		if err := decoder.Decode(&sample); err != nil {
+			return fmt.Errorf("sample %d: %w", record, err)
+		}
+		if err := b.add(record, sample); err != nil {
+			return err
+		}
+	}
+
+	_, err := decoder.Token()
+	return err
+}
+
+func readJSONL(r io.Reader, b *batcher) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	record := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record++
+
+		var sample db.UsageSample
+		if err := json.Unmarshal(line, &sample); err != nil {
+			return fmt.Errorf("sample %d: %w", record, err)
+		}
+		if err := b.add(record, sample); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Import reads samples in the given format and records them in the database. Each batch of samples is recorded in
+// its own transaction, so the batches before a malformed sample are kept. It returns the number of samples recorded.
+func Import(context context.Context, database *db.Database, r io.Reader, format Format) (int, error) {
+	return Read(r, format, func(batch []db.UsageSample) error {
+		return database.WithTx(context, func(tx *db.Database) error {
+			return tx.AddUsageSamples(context, batch)
+		})
+	})
+}
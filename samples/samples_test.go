@@ -0,0 +1,124 @@
+package samples
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+func TestRead(t *testing.T) {
+	inputs := map[Format]string{
+		FormatCSV: "millicores_used,analysis_id,sampled_at\n" +
+			"250,a1,2024-03-01T12:00:00Z\n" +
+			"500.5,a1,2024-03-01T12:01:00Z\n",
+		FormatJSON: `[
+			{"analysis_id": "a1", "sampled_at": "2024-03-01T12:00:00Z", "millicores_used": 250},
+			{"analysis_id": "a1", "sampled_at": "2024-03-01T12:01:00Z", "millicores_used": 500.5}
+		]`,
+		FormatJSONL: `{"analysis_id": "a1", "sampled_at": "2024-03-01T12:00:00Z", "millicores_used": 250}
+
+{"analysis_id": "a1", "sampled_at": "2024-03-01T12:01:00Z", "millicores_used": 500.5}
+`,
+	}
+
+	for format, input := range inputs {
+		t.Run(string(format), func(t *testing.T) {
+			var read []db.UsageSample
+			count, err := Read(strings.NewReader(input), format, func(batch []db.UsageSample) error {
+				read = append(read, batch...)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if count != 2 || len(read) != 2 {
+				t.Fatalf("expected 2 samples, got %d (%d passed to the callback)", count, len(read))
+			}
+			if read[1].AnalysisID != "a1" || read[1].MillicoresUsed != 500.5 {
+				t.Errorf("unexpected sample: %+v", read[1])
+			}
+			if !read[1].SampledAt.Equal(time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC)) {
+				t.Errorf("unexpected sample time: %s", read[1].SampledAt)
+			}
+		})
+	}
+}
+
+func TestReadBatches(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < batchSize+1; i++ {
+		fmt.Fprintf(&input, `{"analysis_id": "a1", "sampled_at": "2024-03-01T12:00:%02dZ", "millicores_used": 100}`+"\n", i%60)
+	}
+
+	var batches []int
+	count, err := Read(strings.NewReader(input.String()), FormatJSONL, func(batch []db.UsageSample) error {
+		batches = append(batches, len(batch))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if count != batchSize+1 || len(batches) != 2 || batches[0] != batchSize || batches[1] != 1 {
+		t.Errorf("unexpected batches: %v (%d samples)", batches, count)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	inputs := map[string]string{
+		"missing analysis": `{"sampled_at": "2024-03-01T12:00:00Z", "millicores_used": 250}`,
+		"missing time":     `{"analysis_id": "a1", "millicores_used": 250}`,
+		"negative usage":   `{"analysis_id": "a1", "sampled_at": "2024-03-01T12:00:00Z", "millicores_used": -1}`,
+		"malformed":        `{"analysis_id": `,
+	}
+
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(strings.NewReader(input), FormatJSONL, func([]db.UsageSample) error { return nil })
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("expected an ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadCountsAcceptedBatches(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < batchSize+10; i++ {
+		fmt.Fprintf(&input, `{"analysis_id": "a1", "sampled_at": "2024-03-01T12:00:%02dZ", "millicores_used": 100}`+"\n", i%60)
+	}
+	valid := input.String()
+
+	t.Run("failed batch", func(t *testing.T) {
+		batches := 0
+		count, err := Read(strings.NewReader(valid), FormatJSONL, func([]db.UsageSample) error {
+			batches++
+			if batches == 2 {
+				return errors.New("unable to record the batch")
+			}
+			return nil
+		})
+		if err == nil || errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected the batch error to be returned, got %v", err)
+		}
+		if count != batchSize {
+			t.Errorf("expected %d samples to be counted, got %d", batchSize, count)
+		}
+	})
+
+	t.Run("invalid sample", func(t *testing.T) {
+		input := valid + `{"analysis_id": "a1", "millicores_used": 250}` + "\n"
+		count, err := Read(strings.NewReader(input), FormatJSONL, func([]db.UsageSample) error { return nil })
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if count != batchSize {
+			t.Errorf("expected %d samples to be counted, got %d", batchSize, count)
+		}
+	})
+}